@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Container groups cartons or other containers, such as cases on a pallet.
+// Parent is the container it is packed in itself.
+type Container struct {
+	Id      string    `json:"id"`
+	Type    string    `json:"type"`
+	Owner   string    `json:"owner"`
+	Parent  string    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type ContainerContents struct {
+	Container    Container `json:"container"`
+	CartonIds    []string  `json:"cartonIds"`
+	ContainerIds []string  `json:"containerIds"`
+}
+
+// AggregationRequest names a container and the cartons and containers to pack into or unpack from it
+type AggregationRequest struct {
+	ContainerId  string   `json:"containerId"`
+	CartonIds    []string `json:"cartonIds"`
+	ContainerIds []string `json:"containerIds"`
+}
+
+const IndexContainer = "cn~container"
+
+// (containerId, ContentCarton|ContentContainer, childId) -> what a container holds
+const IndexContent = "cn~content"
+
+const ContainerPallet = "pallet"
+const ContainerCase = "case"
+
+const ContentCarton = "carton"
+const ContentContainer = "container"
+
+// Nesting maps a container type to the container types it may hold. Every
+// container may hold cartons.
+var Nesting = map[string][]string{
+	ContainerPallet: {ContainerCase},
+	ContainerCase:   {},
+}
+
+func (t *CounterfeitCC) getContainer(stub shim.ChaincodeStubInterface, containerId string) (Container, error) {
+	key, _ := stub.CreateCompositeKey(IndexContainer, []string{containerId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return Container{}, errors.New("Error getting container: " + err.Error())
+	} else if data == nil {
+		return Container{}, errors.New("No container for " + containerId)
+	}
+
+	container := Container{}
+	err = json.Unmarshal(data, &container)
+	if err != nil {
+		return Container{}, errors.New("Error parsing container json: " + err.Error())
+	}
+
+	return container, nil
+}
+
+func (t *CounterfeitCC) putContainer(stub shim.ChaincodeStubInterface, container Container) error {
+	key, _ := stub.CreateCompositeKey(IndexContainer, []string{container.Id})
+
+	data, err := json.Marshal(container)
+	if err != nil {
+		return errors.New("Error marshaling container: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing container: " + err.Error())
+	}
+
+	return nil
+}
+
+// getContents returns the ids of the cartons and containers packed directly into the container
+func (t *CounterfeitCC) getContents(stub shim.ChaincodeStubInterface, containerId string) ([]string, []string, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexContent, []string{containerId})
+	if err != nil {
+		return nil, nil, errors.New("Error getting container contents: " + err.Error())
+	}
+	defer iter.Close()
+
+	cartonIds := []string{}
+	containerIds := []string{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, errors.New("Error reading container contents: " + err.Error())
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) != 3 {
+			return nil, nil, errors.New("Error parsing container content key")
+		}
+
+		if attributes[1] == ContentCarton {
+			cartonIds = append(cartonIds, attributes[2])
+		} else {
+			containerIds = append(containerIds, attributes[2])
+		}
+	}
+
+	return cartonIds, containerIds, nil
+}
+
+// collectContents walks the container tree and returns every carton and container below it
+func (t *CounterfeitCC) collectContents(stub shim.ChaincodeStubInterface, containerId string) ([]string, []string, error) {
+	cartonIds, containerIds, err := t.getContents(stub, containerId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, childId := range containerIds {
+		childCartons, childContainers, err := t.collectContents(stub, childId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cartonIds = append(cartonIds, childCartons...)
+		containerIds = append(containerIds, childContainers...)
+	}
+
+	return cartonIds, containerIds, nil
+}
+
+// moveContainer hands the container and everything inside it to the new owner
+func (t *CounterfeitCC) moveContainer(stub shim.ChaincodeStubInterface, containerId string, newOwner string) error {
+	cartonIds, containerIds, err := t.collectContents(stub, containerId)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range append([]string{containerId}, containerIds...) {
+		container, err := t.getContainer(stub, id)
+		if err != nil {
+			return err
+		}
+
+		container.Owner = newOwner
+		err = t.putContainer(stub, container)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, cartonId := range cartonIds {
+		err = t.updateCartonOwner(stub, cartonId, newOwner)
+		if err != nil {
+			return err
+		}
+
+		err = t.distributeCarton(stub, cartonId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) createContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	container := Container{}
+	err = json.Unmarshal([]byte(args[0]), &container)
+	if err != nil {
+		return shim.Error("Error parsing container json")
+	}
+
+	if _, ok := Nesting[container.Type]; !ok {
+		return shim.Error("Unknown container type '" + container.Type + "'")
+	}
+
+	container.Id, err = newIdGenerator(stub).nextFree(IndexContainer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	container.Owner = user.Name
+	container.Parent = ""
+	container.Created, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putContainer(stub, container)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error("Error generating container response")
+	}
+
+	return shim.Success(data)
+}
+
+// ownedUnlockedContainer loads a container of the caller that no transfer
+// offer locks, neither on itself nor on a container it is packed in
+func (t *CounterfeitCC) ownedUnlockedContainer(stub shim.ChaincodeStubInterface, owner string, containerId string) (Container, error) {
+	container, err := t.getContainer(stub, containerId)
+	if err != nil {
+		return Container{}, err
+	}
+
+	if container.Owner != owner {
+		return Container{}, errors.New("Container " + containerId + " doesn't belong to you!")
+	}
+
+	for current := container; ; {
+		pending, err := t.pendingTransfer(stub, transferLockKey(stub, "", current.Id))
+		if err != nil {
+			return Container{}, err
+		} else if pending != nil {
+			return Container{}, errors.New("Container " + current.Id + " is locked by transfer offer " + pending.Id)
+		}
+
+		if current.Parent == "" {
+			break
+		}
+
+		current, err = t.getContainer(stub, current.Parent)
+		if err != nil {
+			return Container{}, err
+		}
+	}
+
+	return container, nil
+}
+
+func parseAggregationRequest(args []string) (AggregationRequest, error) {
+	if len(args) != 1 {
+		return AggregationRequest{}, errors.New("expected 1 argument")
+	}
+
+	request := AggregationRequest{}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return AggregationRequest{}, errors.New("Error parsing aggregation request json")
+	}
+
+	return request, nil
+}
+
+// aggregate packs the caller's loose cartons and containers into one of its containers
+func (t *CounterfeitCC) aggregate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request, err := parseAggregationRequest(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(request.CartonIds) == 0 && len(request.ContainerIds) == 0 {
+		return shim.Error("Nothing to aggregate")
+	}
+
+	parent, err := t.ownedUnlockedContainer(stub, user.Name, request.ContainerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, cartonId := range request.CartonIds {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if carton.Owner != user.Name {
+			return shim.Error("Carton " + cartonId + " doesn't belong to you!")
+		} else if carton.Parent != "" {
+			return shim.Error("Carton " + cartonId + " is already packed in container " + carton.Parent)
+		}
+
+		pending, err := t.pendingTransfer(stub, transferLockKey(stub, cartonId, ""))
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if pending != nil {
+			return shim.Error("Carton " + cartonId + " is locked by transfer offer " + pending.Id)
+		}
+
+		carton.Parent = parent.Id
+		err = t.putCarton(stub, carton)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexContent, []string{parent.Id, ContentCarton, cartonId})
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return shim.Error("Error indexing container contents: " + err.Error())
+		}
+	}
+
+	for _, containerId := range request.ContainerIds {
+		child, err := t.ownedUnlockedContainer(stub, user.Name, containerId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if child.Parent != "" {
+			return shim.Error("Container " + containerId + " is already packed in container " + child.Parent)
+		} else if !contains(Nesting[parent.Type], child.Type) {
+			return shim.Error("A " + parent.Type + " can't hold a " + child.Type)
+		}
+
+		child.Parent = parent.Id
+		err = t.putContainer(stub, child)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexContent, []string{parent.Id, ContentContainer, containerId})
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return shim.Error("Error indexing container contents: " + err.Error())
+		}
+	}
+
+	return containerSuccess(parent)
+}
+
+// disaggregate unpacks the listed cartons and containers, or everything if none are listed
+func (t *CounterfeitCC) disaggregate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request, err := parseAggregationRequest(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	parent, err := t.ownedUnlockedContainer(stub, user.Name, request.ContainerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cartonIds, containerIds := request.CartonIds, request.ContainerIds
+	if len(cartonIds) == 0 && len(containerIds) == 0 {
+		cartonIds, containerIds, err = t.getContents(stub, parent.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	for _, cartonId := range cartonIds {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if carton.Parent != parent.Id {
+			return shim.Error("Carton " + cartonId + " isn't packed in container " + parent.Id)
+		}
+
+		carton.Parent = ""
+		err = t.putCarton(stub, carton)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexContent, []string{parent.Id, ContentCarton, cartonId})
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error indexing container contents: " + err.Error())
+		}
+	}
+
+	for _, containerId := range containerIds {
+		child, err := t.getContainer(stub, containerId)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if child.Parent != parent.Id {
+			return shim.Error("Container " + containerId + " isn't packed in container " + parent.Id)
+		}
+
+		child.Parent = ""
+		err = t.putContainer(stub, child)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexContent, []string{parent.Id, ContentContainer, containerId})
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error indexing container contents: " + err.Error())
+		}
+	}
+
+	return containerSuccess(parent)
+}
+
+func containerSuccess(container Container) pb.Response {
+	data, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error("Error generating container response")
+	}
+
+	return shim.Success(data)
+}
+
+func (t *CounterfeitCC) getContainerContents(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	request := AggregationRequest{}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing container request json")
+	}
+
+	container, err := t.getContainer(stub, request.ContainerId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.containerResponse(stub, container)
+}
+
+func (t *CounterfeitCC) containerResponse(stub shim.ChaincodeStubInterface, container Container) pb.Response {
+	cartonIds, containerIds, err := t.getContents(stub, container.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response := ContainerContents{
+		Container:    container,
+		CartonIds:    cartonIds,
+		ContainerIds: containerIds,
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Error generating container response")
+	}
+
+	return shim.Success(data)
+}
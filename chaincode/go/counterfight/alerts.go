@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Alert is raised when a verification or a sale doesn't fit the custody
+// chain of the package, it waits for the producer or the admin to triage it
+type Alert struct {
+	Id        string       `json:"id"`
+	Rule      string       `json:"rule"`
+	Trigger   string       `json:"trigger"`
+	Status    string       `json:"status"`
+	CartonId  string       `json:"cartonId"`
+	PackageId string       `json:"packageId"`
+	Producer  string       `json:"producer"`
+	Actor     string       `json:"actor"`
+	Gln       string       `json:"gln,omitempty"`
+	Geo       *GeoLocation `json:"geo,omitempty"`
+	Detail    string       `json:"detail"`
+	TxId      string       `json:"txId"`
+	Time      time.Time    `json:"time"`
+	Note      string       `json:"note,omitempty"`
+	TriagedBy string       `json:"triagedBy,omitempty"`
+	Triaged   time.Time    `json:"triaged"`
+}
+
+// AlertQuery asks for the next page of alerts after Bookmark, optionally only
+// those with a status or of a rule
+type AlertQuery struct {
+	Status   string `json:"status,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+	PageSize int    `json:"pageSize,omitempty"`
+	Bookmark string `json:"bookmark,omitempty"`
+}
+
+// AlertPage is one page of alerts. Bookmark is empty on the last page.
+type AlertPage struct {
+	Alerts   []Alert `json:"alerts"`
+	Bookmark string  `json:"bookmark"`
+}
+
+// AlertTriage closes an open alert as confirmed or dismissed
+type AlertTriage struct {
+	AlertId string `json:"alertId"`
+	Status  string `json:"status"`
+	Note    string `json:"note,omitempty"`
+}
+
+// Sighting is where and when the package was last seen
+type Sighting struct {
+	Time time.Time
+	Gln  string
+	Geo  GeoLocation
+}
+
+// RuleContext is what the rules get to see of a verification or a sale.
+// Scans are the earlier scans of the package, Previous is where it was
+// seen last before, if anywhere. Signature is the result of checking the
+// scanned tag signature, empty if none was scanned.
+type RuleContext struct {
+	Trigger   string
+	Actor     User
+	Carton    Carton
+	Package   Package
+	Time      time.Time
+	Gln       string
+	Geo       *GeoLocation
+	Country   string
+	Scans     []Scan
+	Previous  *Sighting
+	Signature string
+}
+
+// Rule returns a description of what is wrong or "" if the event is fine
+type Rule struct {
+	Name     string
+	Triggers []string
+	Check    func(ctx RuleContext) string
+}
+
+// alertId -> Alert
+const IndexAlert = "cn~alert"
+
+// (producer, alertId) -> the alerts about a producer's goods
+const IndexProducerAlert = "cn~produceralert"
+
+// events the rules run on
+const TriggerVerification = "verification"
+const TriggerSale = "sale"
+
+// rules
+const RuleScanAfterDispensing = "scan-after-dispensing"
+const RuleNonOwnerScan = "non-owner-scan"
+const RuleImpossibleTravel = "impossible-travel"
+const RuleOutOfTerritory = "out-of-territory"
+const RuleInvalidSignature = "invalid-signature"
+
+// status of an alert
+const AlertOpen = "open"
+const AlertConfirmed = "confirmed"
+const AlertDismissed = "dismissed"
+
+// goods don't travel faster than an airliner, in km/h
+const MaxTravelSpeed = 1000
+
+// distances below this, in km, are taken as the same place
+const MinTravelDistance = 50
+
+const EarthRadius = 6371
+
+// Rules are checked in this order on every verification and sale
+var Rules = []Rule{
+	{RuleScanAfterDispensing, []string{TriggerVerification}, checkScanAfterDispensing},
+	{RuleNonOwnerScan, []string{TriggerVerification}, checkNonOwnerScan},
+	{RuleImpossibleTravel, []string{TriggerVerification, TriggerSale}, checkImpossibleTravel},
+	{RuleOutOfTerritory, []string{TriggerSale}, checkOutOfTerritory},
+	{RuleInvalidSignature, []string{TriggerVerification}, checkInvalidSignature},
+}
+
+// checkScanAfterDispensing flags a sold package that is checked more often than a buyer would
+func checkScanAfterDispensing(ctx RuleContext) string {
+	if ctx.Package.State != PackageDispensed {
+		return ""
+	}
+
+	scansAfterSale := 0
+	for _, scan := range ctx.Scans {
+		if scan.Time.After(ctx.Package.SellDate) {
+			scansAfterSale++
+		}
+	}
+
+	if scansAfterSale < MaxScansAfterSale {
+		return ""
+	}
+
+	return "Scan " + strconv.Itoa(scansAfterSale+1) + " after the sale on " + ctx.Package.SellDate.Format(time.RFC3339)
+}
+
+// checkNonOwnerScan flags a participant other than the producer checking
+// goods in distribution it doesn't hold. Consumers aren't participants.
+func checkNonOwnerScan(ctx RuleContext) string {
+	if ctx.Actor.Role == "" || ctx.Actor.Name == ctx.Carton.Producer {
+		return ""
+	}
+
+	if ctx.Package.State != PackageCreated && ctx.Package.State != PackageInDistribution {
+		return ""
+	}
+
+	owner := packageOwner(ctx.Carton, ctx.Package)
+	if owner == ctx.Actor.Name {
+		return ""
+	}
+
+	return "Scanned by " + ctx.Actor.Name + " while held by " + owner
+}
+
+// checkImpossibleTravel flags a package seen too far from where it was seen last in too short a time
+func checkImpossibleTravel(ctx RuleContext) string {
+	if ctx.Geo == nil || ctx.Previous == nil {
+		return ""
+	}
+
+	distance := distanceKm(ctx.Previous.Geo, *ctx.Geo)
+	if distance < MinTravelDistance {
+		return ""
+	}
+
+	hours := ctx.Time.Sub(ctx.Previous.Time).Hours()
+	if hours > 0 && distance/hours <= MaxTravelSpeed {
+		return ""
+	}
+
+	from := "the last scan"
+	if ctx.Previous.Gln != "" {
+		from = "site " + ctx.Previous.Gln
+	}
+
+	return strconv.Itoa(int(distance)) + " km from " + from + " in " + ctx.Time.Sub(ctx.Previous.Time).String()
+}
+
+// checkOutOfTerritory flags a sale at a site outside the countries the carton is authorized for
+func checkOutOfTerritory(ctx RuleContext) string {
+	if len(ctx.Carton.Territories) == 0 || ctx.Country == "" || contains(ctx.Carton.Territories, ctx.Country) {
+		return ""
+	}
+
+	return "Sold in " + ctx.Country + ", authorized for " + strings.Join(ctx.Carton.Territories, ", ")
+}
+
+// checkInvalidSignature flags a tag whose signature none of the producer's keys made
+func checkInvalidSignature(ctx RuleContext) string {
+	if ctx.Signature != SignatureInvalid {
+		return ""
+	}
+
+	return "The tag signature doesn't match a key of " + ctx.Carton.Producer
+}
+
+// distanceKm is the great-circle distance between two positions
+func distanceKm(a GeoLocation, b GeoLocation) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+// eventLocation works out where a verification or sale happens: at a site of
+// the actor or, for consumers, at the position the app reports
+func (t *CounterfeitCC) eventLocation(stub shim.ChaincodeStubInterface, actor string, gln string, geo *GeoLocation) (*GeoLocation, string, error) {
+	if gln != "" {
+		err := t.checkSite(stub, gln, actor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		site, err := t.getSite(stub, gln)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return &site.Geo, site.Address.Country, nil
+	}
+
+	if geo != nil {
+		err := validateGeo(*geo)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return geo, "", nil
+}
+
+// lastSighting returns where the package was seen last: the latest stop at a
+// site or scan with a position
+func (t *CounterfeitCC) lastSighting(stub shim.ChaincodeStubInterface, cartonId string, packageId string, scans []Scan) (*Sighting, error) {
+	stops, err := t.getPackageStops(stub, cartonId, packageId)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *Sighting
+	for _, stop := range stops {
+		if stop.Gln == "" || last != nil && !stop.Time.After(last.Time) {
+			continue
+		}
+
+		site, err := t.getSite(stub, stop.Gln)
+		if err != nil {
+			return nil, err
+		}
+
+		last = &Sighting{Time: stop.Time, Gln: stop.Gln, Geo: site.Geo}
+	}
+
+	for _, scan := range scans {
+		if scan.Geo == nil || last != nil && !scan.Time.After(last.Time) {
+			continue
+		}
+
+		last = &Sighting{Time: scan.Time, Gln: scan.Gln, Geo: *scan.Geo}
+	}
+
+	return last, nil
+}
+
+// newRuleContext collects what the rules need to know about an event of a package
+func (t *CounterfeitCC) newRuleContext(stub shim.ChaincodeStubInterface, trigger string, actor string, ref PackageRef, geo *GeoLocation, country string) (RuleContext, error) {
+	ctx := RuleContext{Trigger: trigger, Gln: ref.Site, Geo: geo, Country: country}
+
+	var err error
+	ctx.Carton, err = t.getCarton(stub, ref.CartonId)
+	if err != nil {
+		return RuleContext{}, err
+	}
+
+	ctx.Package, err = t.getPackage(stub, ref.CartonId, ref.PackageId)
+	if err != nil {
+		return RuleContext{}, err
+	}
+
+	// consumers aren't registered, they get no role
+	ctx.Actor, err = t.findUser(stub, actor)
+	if err != nil {
+		ctx.Actor = User{Name: actor}
+	}
+
+	ctx.Time, err = txTime(stub)
+	if err != nil {
+		return RuleContext{}, err
+	}
+
+	ctx.Scans, err = t.getScans(stub, ref)
+	if err != nil {
+		return RuleContext{}, err
+	}
+
+	ctx.Previous, err = t.lastSighting(stub, ref.CartonId, ref.PackageId, ctx.Scans)
+	if err != nil {
+		return RuleContext{}, err
+	}
+
+	return ctx, nil
+}
+
+// runRules checks the event against every rule for its trigger and records an alert for each one that fails
+func (t *CounterfeitCC) runRules(stub shim.ChaincodeStubInterface, ctx RuleContext) ([]Alert, error) {
+	ids := newIdGenerator(stub)
+
+	var alerts []Alert
+	for _, rule := range Rules {
+		if !contains(rule.Triggers, ctx.Trigger) {
+			continue
+		}
+
+		detail := rule.Check(ctx)
+		if detail == "" {
+			continue
+		}
+
+		id, err := ids.nextFree(IndexAlert)
+		if err != nil {
+			return nil, err
+		}
+
+		alert := Alert{
+			Id:        id,
+			Rule:      rule.Name,
+			Trigger:   ctx.Trigger,
+			Status:    AlertOpen,
+			CartonId:  ctx.Carton.Id,
+			PackageId: ctx.Package.Id,
+			Producer:  ctx.Carton.Producer,
+			Actor:     ctx.Actor.Name,
+			Gln:       ctx.Gln,
+			Geo:       ctx.Geo,
+			Detail:    detail,
+			TxId:      stub.GetTxID(),
+			Time:      ctx.Time,
+		}
+
+		err = t.putAlert(stub, alert)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexProducerAlert, []string{alert.Producer, alert.Id})
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return nil, errors.New("Error indexing alert: " + err.Error())
+		}
+
+		err = emitEvent(stub, Event{
+			Type:      EventAlertRaised,
+			Actor:     alert.Actor,
+			CartonId:  alert.CartonId,
+			PackageId: alert.PackageId,
+			AlertId:   alert.Id,
+			Rule:      alert.Rule,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, nil
+}
+
+func (t *CounterfeitCC) getAlert(stub shim.ChaincodeStubInterface, alertId string) (Alert, error) {
+	key, _ := stub.CreateCompositeKey(IndexAlert, []string{alertId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return Alert{}, errors.New("Error getting alert: " + err.Error())
+	} else if data == nil {
+		return Alert{}, errors.New("No alert for " + alertId)
+	}
+
+	alert := Alert{}
+	err = json.Unmarshal(data, &alert)
+	if err != nil {
+		return Alert{}, errors.New("Error parsing alert json: " + err.Error())
+	}
+
+	return alert, nil
+}
+
+func (t *CounterfeitCC) putAlert(stub shim.ChaincodeStubInterface, alert Alert) error {
+	key, _ := stub.CreateCompositeKey(IndexAlert, []string{alert.Id})
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return errors.New("Error marshaling alert: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing alert: " + err.Error())
+	}
+
+	return nil
+}
+
+// listAlerts returns a page of the alerts about the caller's goods, the admin gets all alerts
+func (t *CounterfeitCC) listAlerts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("expected at most 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	query := AlertQuery{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			return shim.Error("Error parsing alert query json")
+		}
+	}
+
+	query.PageSize, err = checkPageSize(query.PageSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	index, attributes := IndexProducerAlert, []string{caller}
+	if t.checkAdmin(stub) == nil {
+		index, attributes = IndexAlert, []string{}
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(index, attributes)
+	if err != nil {
+		return shim.Error("Error listing alerts: " + err.Error())
+	}
+	defer iter.Close()
+
+	page := AlertPage{Alerts: []Alert{}}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error("Error listing alerts: " + err.Error())
+		}
+
+		_, keyAttributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(keyAttributes) != len(attributes)+1 {
+			return shim.Error("Error parsing alert key")
+		}
+
+		alertId := keyAttributes[len(attributes)]
+		if query.Bookmark != "" && alertId <= query.Bookmark {
+			continue
+		}
+
+		alert, err := t.getAlert(stub, alertId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if query.Status != "" && alert.Status != query.Status || query.Rule != "" && alert.Rule != query.Rule {
+			continue
+		}
+
+		// one match past a full page means there is another page
+		if len(page.Alerts) == query.PageSize {
+			page.Bookmark = page.Alerts[len(page.Alerts)-1].Id
+			break
+		}
+
+		page.Alerts = append(page.Alerts, alert)
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Error generating alert list response")
+	}
+
+	return shim.Success(data)
+}
+
+// triageAlert lets the producer of the goods or the admin confirm or dismiss an open alert
+func (t *CounterfeitCC) triageAlert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	triage := AlertTriage{}
+	err = json.Unmarshal([]byte(args[0]), &triage)
+	if err != nil {
+		return shim.Error("Error parsing triageAlert request json")
+	}
+
+	if triage.Status != AlertConfirmed && triage.Status != AlertDismissed {
+		return shim.Error("An alert can only be " + AlertConfirmed + " or " + AlertDismissed)
+	}
+
+	alert, err := t.getAlert(stub, triage.AlertId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if alert.Producer != caller && t.checkAdmin(stub) != nil {
+		return shim.Error("Alert " + alert.Id + " is not about your goods")
+	} else if alert.Status != AlertOpen {
+		return shim.Error("Alert " + alert.Id + " is " + alert.Status)
+	}
+
+	alert.Status = triage.Status
+	alert.Note = triage.Note
+	alert.TriagedBy = caller
+	alert.Triaged, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.putAlert(stub, alert)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return shim.Error("Error generating alert response")
+	}
+
+	return shim.Success(data)
+}
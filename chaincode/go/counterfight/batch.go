@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// items per batch call unless the settings say otherwise
+const DefaultMaxBatchSize = 100
+
+// batchError fails the whole batch naming the item that failed
+func batchError(index int, err error) pb.Response {
+	return shim.Error("Item " + strconv.Itoa(index) + ": " + err.Error())
+}
+
+// checkBatchSize makes sure the batch isn't empty and within the configured maximum
+func (t *CounterfeitCC) checkBatchSize(stub shim.ChaincodeStubInterface, size int) error {
+	settings, err := t.getSettings(stub)
+	if err != nil {
+		return errors.New("Error getting settings: " + err.Error())
+	}
+
+	max := settings.MaxBatchSize
+	if max <= 0 {
+		max = DefaultMaxBatchSize
+	}
+
+	if size == 0 {
+		return errors.New("The batch is empty")
+	} else if size > max {
+		return errors.New("The batch has " + strconv.Itoa(size) + " items, at most " + strconv.Itoa(max) + " are allowed")
+	}
+
+	return nil
+}
+
+// createCartons registers a JSON array of cartons. Every carton is validated
+// before the first one is written, one invalid carton fails the whole batch.
+func (t *CounterfeitCC) createCartons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var cartons []Carton
+	err = json.Unmarshal([]byte(args[0]), &cartons)
+	if err != nil {
+		return shim.Error("Error parsing carton list json")
+	}
+
+	err = t.checkBatchSize(stub, len(cartons))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ids := newIdGenerator(stub)
+	for i := range cartons {
+		cartons[i], err = t.prepareCarton(stub, ids, user.Name, cartons[i])
+		if err != nil {
+			return batchError(i, err)
+		}
+	}
+
+	var result []CreateCartonResponse = []CreateCartonResponse{}
+	for i, carton := range cartons {
+		packages, err := t.createCarton(stub, ids, carton)
+		if err != nil {
+			return batchError(i, err)
+		}
+
+		result = append(result, CreateCartonResponse{Carton: carton, PackageList: *packages})
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating response")
+	}
+
+	return shim.Success(data)
+}
+
+// sellCartons opens a transfer offer for every item of a JSON array of
+// CartonRefs. All offers are checked first, also against each other, so
+// either all of them are opened or none.
+func (t *CounterfeitCC) sellCartons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var refs []CartonRef
+	err = json.Unmarshal([]byte(args[0]), &refs)
+	if err != nil {
+		return shim.Error("Error parsing sellCartons request json")
+	}
+
+	err = t.checkBatchSize(stub, len(refs))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the ledger doesn't show this transaction's own locks, so the items
+	// are checked against each other here
+	locked := map[string]bool{}
+	checked := map[string]bool{}
+	for i, ref := range refs {
+		err = t.checkOffer(stub, user, ref)
+		if err != nil {
+			return batchError(i, err)
+		}
+
+		lockKeys := transferLockKeys(stub, ref.CartonId, ref.ContainerId, ref.PackageIds)
+		var checkKeys []string
+		if len(ref.PackageIds) > 0 {
+			checkKeys = append(checkKeys, transferLockKey(stub, ref.CartonId, ""))
+		}
+
+		for _, key := range append(lockKeys, checkKeys...) {
+			if locked[key] {
+				return batchError(i, errors.New("Goods are already offered in this batch"))
+			}
+		}
+		for _, key := range lockKeys {
+			if checked[key] {
+				return batchError(i, errors.New("Goods are already offered in this batch"))
+			}
+			locked[key] = true
+		}
+		for _, key := range checkKeys {
+			checked[key] = true
+		}
+	}
+
+	ids := newIdGenerator(stub)
+	var result []TransferOffer = []TransferOffer{}
+	for i, ref := range refs {
+		offer, err := t.offerTransfer(stub, ids, user, ref)
+		if err != nil {
+			return batchError(i, err)
+		}
+
+		result = append(result, offer)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating transfer offer response")
+	}
+
+	return shim.Success(data)
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Range is an inclusive interval of allowed values
+type Range struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// StorageConditions are what the product tolerates, the temperature in °C
+// and the relative humidity in percent. A missing range isn't checked.
+type StorageConditions struct {
+	Temperature *Range `json:"temperature,omitempty"`
+	Humidity    *Range `json:"humidity,omitempty"`
+}
+
+// SensorReading is one measurement of a data logger, it may lack either value
+type SensorReading struct {
+	Time        time.Time `json:"time"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Humidity    *float64  `json:"humidity,omitempty"`
+}
+
+// ReadingBatch holds the readings a data logger took of a carton or of a
+// container and everything packed in it
+type ReadingBatch struct {
+	CartonId    string          `json:"cartonId,omitempty"`
+	ContainerId string          `json:"containerId,omitempty"`
+	Sensor      string          `json:"sensor"`
+	Readings    []SensorReading `json:"readings"`
+}
+
+// SignedReadings carries a ReadingBatch exactly as the data logger signed it.
+// Signature is the base64 ASN.1 ECDSA signature over the SHA-256 of Batch,
+// made with the key of the registered certificate of the batch's sensor.
+type SignedReadings struct {
+	Batch     json.RawMessage `json:"batch"`
+	Signature string          `json:"signature"`
+}
+
+// Sensor is a data logger the admin vouches for. Certificate is its PEM
+// certificate, the CN is the sensor id.
+type Sensor struct {
+	Id           string    `json:"id"`
+	Certificate  string    `json:"certificate"`
+	RegisteredBy string    `json:"registeredBy"`
+	Registered   time.Time `json:"registered"`
+}
+
+// SensorBatch is a reading batch as recorded on the ledger, Id is the hex SHA-256 of the signed batch
+type SensorBatch struct {
+	Id        string          `json:"id"`
+	Sensor    string          `json:"sensor"`
+	Submitter string          `json:"submitter"`
+	TxId      string          `json:"txId"`
+	Received  time.Time       `json:"received"`
+	CartonIds []string        `json:"cartonIds"`
+	Readings  []SensorReading `json:"readings"`
+}
+
+// Excursion is a run of consecutive readings of one measure outside the allowed range
+type Excursion struct {
+	Measure string    `json:"measure"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Peak    float64   `json:"peak"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Sensor  string    `json:"sensor"`
+	BatchId string    `json:"batchId"`
+}
+
+// ColdChainStatus sums up the storage conditions a carton went through
+type ColdChainStatus struct {
+	CartonId    string      `json:"cartonId"`
+	Status      string      `json:"status"`
+	Readings    int         `json:"readings"`
+	LastReading time.Time   `json:"lastReading"`
+	Excursions  []Excursion `json:"excursions"`
+	Released    time.Time   `json:"released"`
+	ReleasedBy  string      `json:"releasedBy,omitempty"`
+}
+
+type ColdChainRef struct {
+	CartonId string `json:"cartonId"`
+}
+
+// sensorId -> Sensor, the loggers whose readings are accepted
+const IndexSensor = "cn~sensor"
+
+// cartonId -> ColdChainStatus
+const IndexColdChain = "cn~coldchain"
+
+// batchId -> SensorBatch
+const IndexSensorBatch = "cn~sensorbatch"
+
+// (cartonId, batchId) -> the reading batches of a carton
+const IndexCartonBatch = "cn~cartonbatch"
+
+// cold chain status of a carton
+const ColdChainOk = "ok"
+const ColdChainQuarantined = "quarantined"
+const ColdChainReleased = "released"
+
+// measures of a reading
+const MeasureTemperature = "temperature"
+const MeasureHumidity = "humidity"
+
+// readings per batch, a logger taking one every five minutes fills it in about three days
+const MaxReadingsPerBatch = 1000
+
+// validateStorage checks the storage conditions of a new carton
+func validateStorage(storage *StorageConditions) error {
+	if storage == nil {
+		return nil
+	}
+
+	if storage.Temperature != nil && storage.Temperature.Min > storage.Temperature.Max {
+		return errors.New("The minimum temperature must not be above the maximum")
+	}
+
+	if storage.Humidity != nil {
+		if storage.Humidity.Min > storage.Humidity.Max {
+			return errors.New("The minimum humidity must not be above the maximum")
+		} else if storage.Humidity.Min < 0 || storage.Humidity.Max > 100 {
+			return errors.New("The humidity range must be within 0 and 100 percent")
+		}
+	}
+
+	return nil
+}
+
+// verifyECDSA checks a base64 ASN.1 ECDSA signature over the SHA-256 of the data
+func verifyECDSA(key *ecdsa.PublicKey, data []byte, signature string) error {
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("The signature is not valid base64")
+	}
+
+	sig := struct {
+		R, S *big.Int
+	}{}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return errors.New("The signature is not a valid ECDSA signature")
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+		return errors.New("The signature doesn't match")
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) getSensor(stub shim.ChaincodeStubInterface, sensorId string) (Sensor, error) {
+	key, _ := stub.CreateCompositeKey(IndexSensor, []string{sensorId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return Sensor{}, errors.New("Error getting sensor: " + err.Error())
+	} else if data == nil {
+		return Sensor{}, errors.New("Sensor " + sensorId + " is not registered")
+	}
+
+	sensor := Sensor{}
+	err = json.Unmarshal(data, &sensor)
+	if err != nil {
+		return Sensor{}, errors.New("Error parsing sensor json: " + err.Error())
+	}
+
+	return sensor, nil
+}
+
+// verifyReadings checks the signature of the batch against the registered
+// certificate of its sensor and returns the parsed batch. The submitter
+// can't bring its own certificate, or it could make up readings.
+func (t *CounterfeitCC) verifyReadings(stub shim.ChaincodeStubInterface, signed SignedReadings, now time.Time) (ReadingBatch, error) {
+	batch := ReadingBatch{}
+	err := json.Unmarshal(signed.Batch, &batch)
+	if err != nil {
+		return ReadingBatch{}, errors.New("Error parsing reading batch json")
+	}
+
+	sensor, err := t.getSensor(stub, batch.Sensor)
+	if err != nil {
+		return ReadingBatch{}, err
+	}
+
+	cert, err := parsePEM(sensor.Certificate)
+	if err != nil {
+		return ReadingBatch{}, errors.New("Failed to parse sensor certificate: " + err.Error())
+	}
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return ReadingBatch{}, errors.New("The sensor certificate is not valid at " + now.Format(time.RFC3339))
+	}
+
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ReadingBatch{}, errors.New("The sensor certificate has no ECDSA key")
+	}
+
+	err = verifyECDSA(key, signed.Batch, signed.Signature)
+	if err != nil {
+		return ReadingBatch{}, errors.New("Invalid reading batch signature: " + err.Error())
+	}
+
+	if len(batch.Readings) == 0 {
+		return ReadingBatch{}, errors.New("The batch has no readings")
+	} else if len(batch.Readings) > MaxReadingsPerBatch {
+		return ReadingBatch{}, errors.New("The batch has " + strconv.Itoa(len(batch.Readings)) + " readings, at most " + strconv.Itoa(MaxReadingsPerBatch) + " are allowed")
+	}
+
+	for _, reading := range batch.Readings {
+		if reading.Time.After(now) {
+			return ReadingBatch{}, errors.New("Reading of " + reading.Time.Format(time.RFC3339) + " is in the future")
+		}
+	}
+
+	sort.SliceStable(batch.Readings, func(i, j int) bool {
+		return batch.Readings[i].Time.Before(batch.Readings[j].Time)
+	})
+
+	return batch, nil
+}
+
+// findExcursions returns the runs of readings outside the storage conditions,
+// the readings must be sorted by time
+func findExcursions(storage *StorageConditions, readings []SensorReading, sensor string, batchId string) []Excursion {
+	var result []Excursion = []Excursion{}
+	if storage == nil {
+		return result
+	}
+
+	measures := []struct {
+		name  string
+		limit *Range
+		value func(SensorReading) *float64
+	}{
+		{MeasureTemperature, storage.Temperature, func(r SensorReading) *float64 { return r.Temperature }},
+		{MeasureHumidity, storage.Humidity, func(r SensorReading) *float64 { return r.Humidity }},
+	}
+
+	for _, measure := range measures {
+		if measure.limit == nil {
+			continue
+		}
+
+		var current *Excursion
+		for _, reading := range readings {
+			value := measure.value(reading)
+			if value == nil {
+				continue
+			}
+
+			inRange := *value >= measure.limit.Min && *value <= measure.limit.Max
+			if inRange {
+				if current != nil {
+					result = append(result, *current)
+					current = nil
+				}
+				continue
+			}
+
+			if current == nil {
+				current = &Excursion{
+					Measure: measure.name,
+					Start:   reading.Time,
+					Peak:    *value,
+					Min:     measure.limit.Min,
+					Max:     measure.limit.Max,
+					Sensor:  sensor,
+					BatchId: batchId,
+				}
+			}
+
+			current.End = reading.Time
+			if *value > measure.limit.Max && *value > current.Peak || *value < measure.limit.Min && *value < current.Peak {
+				current.Peak = *value
+			}
+		}
+
+		if current != nil {
+			result = append(result, *current)
+		}
+	}
+
+	return result
+}
+
+// getColdChain returns the cold chain status of the carton, an ok one without
+// readings if nothing was submitted yet
+func (t *CounterfeitCC) getColdChain(stub shim.ChaincodeStubInterface, cartonId string) (ColdChainStatus, error) {
+	key, _ := stub.CreateCompositeKey(IndexColdChain, []string{cartonId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return ColdChainStatus{}, errors.New("Error getting cold chain status: " + err.Error())
+	} else if data == nil {
+		return ColdChainStatus{CartonId: cartonId, Status: ColdChainOk, Excursions: []Excursion{}}, nil
+	}
+
+	status := ColdChainStatus{}
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return ColdChainStatus{}, errors.New("Error parsing cold chain status json: " + err.Error())
+	}
+
+	return status, nil
+}
+
+func (t *CounterfeitCC) putColdChain(stub shim.ChaincodeStubInterface, status ColdChainStatus) error {
+	key, _ := stub.CreateCompositeKey(IndexColdChain, []string{status.CartonId})
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.New("Error marshaling cold chain status: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing cold chain status: " + err.Error())
+	}
+
+	return nil
+}
+
+// checkNotQuarantined refuses goods of a carton that is quarantined after an excursion
+func (t *CounterfeitCC) checkNotQuarantined(stub shim.ChaincodeStubInterface, cartonId string) error {
+	status, err := t.getColdChain(stub, cartonId)
+	if err != nil {
+		return err
+	} else if status.Status == ColdChainQuarantined {
+		return errors.New("Carton " + cartonId + " is quarantined after a storage excursion")
+	}
+
+	return nil
+}
+
+// quarantinedCartons returns the cartons of the offer that are quarantined
+func (t *CounterfeitCC) quarantinedCartons(stub shim.ChaincodeStubInterface, offer TransferOffer) ([]string, error) {
+	cartonIds := []string{offer.CartonId}
+	if offer.ContainerId != "" {
+		var err error
+		cartonIds, _, err = t.collectContents(stub, offer.ContainerId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []string
+	for _, cartonId := range cartonIds {
+		status, err := t.getColdChain(stub, cartonId)
+		if err != nil {
+			return nil, err
+		}
+
+		if status.Status == ColdChainQuarantined {
+			result = append(result, cartonId)
+		}
+	}
+
+	return result, nil
+}
+
+// withColdChain fills in the quarantined cartons of an offer for a response.
+// It is worked out on every read, the stored offer doesn't carry it.
+func (t *CounterfeitCC) withColdChain(stub shim.ChaincodeStubInterface, offer TransferOffer) (TransferOffer, error) {
+	quarantined, err := t.quarantinedCartons(stub, offer)
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	offer.Quarantined = quarantined
+	return offer, nil
+}
+
+// registerSensor is called by the admin and adds the certificate of a data
+// logger, or replaces the one registered for it
+func (t *CounterfeitCC) registerSensor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sensor := Sensor{}
+	err = json.Unmarshal([]byte(args[0]), &sensor)
+	if err != nil {
+		return shim.Error("Error parsing registerSensor request json")
+	}
+
+	cert, err := parsePEM(sensor.Certificate)
+	if err != nil {
+		return shim.Error("Failed to parse sensor certificate: " + err.Error())
+	} else if cert.Subject.CommonName == "" {
+		return shim.Error("The sensor certificate has no CN")
+	} else if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		return shim.Error("The sensor certificate has no ECDSA key")
+	}
+
+	sensor.Id = cert.Subject.CommonName
+	sensor.RegisteredBy = caller
+	sensor.Registered, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(sensor)
+	if err != nil {
+		return shim.Error("Error marshaling sensor: " + err.Error())
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexSensor, []string{sensor.Id})
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error storing sensor: " + err.Error())
+	}
+
+	return shim.Success(data)
+}
+
+// submitReadings records a signed batch of data logger readings against a
+// carton or a container the caller holds, flags the excursions and
+// quarantines the affected cartons
+func (t *CounterfeitCC) submitReadings(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	signed := SignedReadings{}
+	err = json.Unmarshal([]byte(args[0]), &signed)
+	if err != nil {
+		return shim.Error("Error parsing submitReadings request json")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	batch, err := t.verifyReadings(stub, signed, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var cartonIds []string
+	if (batch.CartonId == "") == (batch.ContainerId == "") {
+		return shim.Error("Either cartonId or containerId is required")
+	} else if batch.ContainerId != "" {
+		container, err := t.getContainer(stub, batch.ContainerId)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if container.Owner != user.Name {
+			return shim.Error("Container " + batch.ContainerId + " doesn't belong to " + user.Name)
+		}
+
+		cartonIds, _, err = t.collectContents(stub, batch.ContainerId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		cartonIds = []string{batch.CartonId}
+	}
+
+	digest := sha256.Sum256(signed.Batch)
+	batchId := hex.EncodeToString(digest[:])
+
+	batchKey, _ := stub.CreateCompositeKey(IndexSensorBatch, []string{batchId})
+	existing, err := stub.GetState(batchKey)
+	if err != nil {
+		return shim.Error("Error getting reading batch: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("Reading batch " + batchId + " was already submitted")
+	}
+
+	var result []ColdChainStatus = []ColdChainStatus{}
+	var quarantined []string
+	for _, cartonId := range cartonIds {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if carton.Owner != user.Name {
+			return shim.Error("Carton " + cartonId + " doesn't belong to " + user.Name)
+		}
+
+		status, err := t.getColdChain(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		status.Readings += len(batch.Readings)
+		if last := batch.Readings[len(batch.Readings)-1].Time; last.After(status.LastReading) {
+			status.LastReading = last
+		}
+
+		excursions := findExcursions(carton.Storage, batch.Readings, batch.Sensor, batchId)
+		if len(excursions) > 0 {
+			status.Excursions = append(status.Excursions, excursions...)
+			status.Status = ColdChainQuarantined
+			quarantined = append(quarantined, cartonId)
+		}
+
+		err = t.putColdChain(stub, status)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexCartonBatch, []string{cartonId, batchId})
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return shim.Error("Error indexing reading batch: " + err.Error())
+		}
+
+		result = append(result, status)
+	}
+
+	data, err := json.Marshal(SensorBatch{
+		Id:        batchId,
+		Sensor:    batch.Sensor,
+		Submitter: user.Name,
+		TxId:      stub.GetTxID(),
+		Received:  now,
+		CartonIds: cartonIds,
+		Readings:  batch.Readings,
+	})
+	if err != nil {
+		return shim.Error("Error marshaling reading batch: " + err.Error())
+	}
+
+	err = stub.PutState(batchKey, data)
+	if err != nil {
+		return shim.Error("Error storing reading batch: " + err.Error())
+	}
+
+	if len(quarantined) > 0 {
+		err = emitEvent(stub, Event{
+			Type:        EventExcursion,
+			Actor:       user.Name,
+			CartonIds:   quarantined,
+			ContainerId: batch.ContainerId,
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	data, err = json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating cold chain response")
+	}
+
+	return shim.Success(data)
+}
+
+// releaseQuarantine lets the producer release a quarantined carton after
+// assessing the excursions, the excursions stay on record
+func (t *CounterfeitCC) releaseQuarantine(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := ColdChainRef{}
+	err = json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing releaseQuarantine request json")
+	}
+
+	carton, err := t.getCarton(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if carton.Producer != user.Name {
+		return shim.Error("Only the producer of carton " + carton.Id + " can release it")
+	}
+
+	status, err := t.getColdChain(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if status.Status != ColdChainQuarantined {
+		return shim.Error("Carton " + carton.Id + " is not quarantined")
+	}
+
+	status.Status = ColdChainReleased
+	status.Released, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status.ReleasedBy = user.Name
+
+	err = t.putColdChain(stub, status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitEvent(stub, Event{Type: EventQuarantineReleased, Actor: user.Name, CartonId: carton.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error("Error generating cold chain response")
+	}
+
+	return shim.Success(data)
+}
+
+// coldChain returns the cold chain status of a carton with its excursions
+func (t *CounterfeitCC) coldChain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := ColdChainRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing getColdChain request json")
+	}
+
+	_, err = t.getCarton(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status, err := t.getColdChain(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error("Error generating cold chain response")
+	}
+
+	return shim.Success(data)
+}
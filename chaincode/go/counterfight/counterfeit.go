@@ -12,14 +12,20 @@ import (
 	"encoding/pem"
 	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/protos/msp"
-	"math/rand"
+	"crypto/sha256"
+	"encoding/binary"
 )
 
 type CounterfeitCC struct {
 }
 
+// Settings of the ledger. Version and Migrations are kept by Init: the
+// chaincode version it last ran with and the migrations done so far.
 type Settings struct {
 	Admin        string `json:"admin"`
+	MaxBatchSize int `json:"maxBatchSize,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Migrations   []string `json:"migrations,omitempty"`
 }
 
 type Carton struct {
@@ -30,17 +36,32 @@ type Carton struct {
 	PackageNum		int `json:"packageNum"`
 	Producer		string `json:"producer"`
 	Owner			string `json:"owner"`
+	Gtin			string `json:"gtin"`
+	Lot				string `json:"lot"`
+	ExpiryDate		time.Time `json:"expiryDate"`
+	Parent			string `json:"parent,omitempty"`
+	Serialized		bool `json:"serialized,omitempty"`
+	Serials			[]string `json:"serials,omitempty"`
+	Storage			*StorageConditions `json:"storage,omitempty"`
+	Site			string `json:"site,omitempty"`
+	Territories		[]string `json:"territories,omitempty"`
 }
 
+// Package belongs to the owner of its carton unless Owner is set
 type Package struct {
 	Id 				string `json:"id"`
+	State			string `json:"state"`
+	Owner			string `json:"owner,omitempty"`
 	Sold   			bool `json:"sold"`
 	SellDate 		time.Time `json:"sellDate"`
+	Signature		string `json:"signature,omitempty"`
+	KeyId			string `json:"keyId,omitempty"`
 }
 
 type User struct {
 	Role    		string `json:"role"`
 	Name        	string `json:"name"`
+	Status			string `json:"status"`
 }
 
 type CreateCartonResponse struct {
@@ -50,24 +71,50 @@ type CreateCartonResponse struct {
 
 type CartonRef struct {
 	CartonId    	string `json:"cartonId"`
+	PackageIds		[]string `json:"packageIds,omitempty"`
+	ContainerId		string `json:"containerId,omitempty"`
 	Buyer        	string `json:"buyer"`
+	ValidFor		int64 `json:"validFor,omitempty"`
+	Site			string `json:"site,omitempty"`
 }
 
+// PackageRef points to a package by its ids, by a GS1 element string with its
+// SGTIN or by the tag code printed on it, see package tagcode.
+// Site is the GLN of the site a sale or scan happens at, Geo the position of
+// a scan by a consumer and Signature the producer's signature on the scanned tag.
 type PackageRef struct {
 	CartonId    	string `json:"cartonId"`
 	PackageId    	string `json:"packageId"`
+	Sgtin			string `json:"sgtin,omitempty"`
+	Site			string `json:"site,omitempty"`
+	Geo				*GeoLocation `json:"geo,omitempty"`
+	Signature		string `json:"signature,omitempty"`
+	Code			string `json:"code,omitempty"`
 }
 
 type HistoryEntry struct {
 	Owner 		string `json:"owner"`
 	TxId 		string `json:"txId"`
 	Timestamp 	int64 `json:"timeStamp"`
+	Time		time.Time `json:"time"`
+	Object		string `json:"object"`
+	Change		string `json:"change"`
+	State		string `json:"state,omitempty"`
+	IsDelete	bool `json:"isDelete"`
 }
 
 type PackageHistoryResponse struct {
 	Carton Carton `json:"carton"`
 	Package Package `json:"package"`
 	OwnerHistory []HistoryEntry `json:"ownerHistory"`
+	Containment []ContainmentEntry `json:"containment"`
+	Returns []ReturnRequest `json:"returns"`
+}
+
+type CartonHistoryResponse struct {
+	Carton Carton `json:"carton"`
+	OwnerHistory []HistoryEntry `json:"ownerHistory"`
+	Returns []ReturnRequest `json:"returns"`
 }
 
 const KeySettings = "__settings"
@@ -77,6 +124,21 @@ const IndexReseller = "cn~reseller"
 const IndexCartons = "cn~carton"
 const IndexPackage = "cn~package"
 
+const RoleProducer = "producer"
+const RolePharmacy = "pharmacy"
+const RoleReseller = "reseller"
+
+var Roles = []string{RoleProducer, RolePharmacy, RoleReseller}
+
+// registry status of a participant
+const UserRequested = "requested"
+const UserApproved = "approved"
+const UserRejected = "rejected"
+const UserSuspended = "suspended"
+
+// how many candidates the id generator tries before giving up on a free key
+const MaxIdAttempts = 16
+
 func (t *CounterfeitCC) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
@@ -85,29 +147,73 @@ func (t *CounterfeitCC) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error("Expected 'init' function.")
 	}
 
-	if len(args) != 1 {
-		return shim.Error("Expected 1 argument, but got " + strconv.Itoa(len(args)))
+	if len(args) > 1 {
+		return shim.Error("Expected at most 1 argument, but got " + strconv.Itoa(len(args)))
 	}
 
-	// get token data from JSON
-	settings := Settings{}
-	err := json.Unmarshal([]byte(args[0]), &settings)
+	// Init runs again on every upgrade, the settings of a running ledger are kept
+	settings, initialized, err := t.storedSettings(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if !initialized && len(args) == 0 {
+		return shim.Error("Expected the settings as argument")
+	}
+
+	// the settings given replace the stored ones, those left out stay
+	if len(args) == 1 {
+		stored := settings
+		options := InitOptions{}
+		err = json.Unmarshal([]byte(args[0]), &settings)
+		if err == nil {
+			err = json.Unmarshal([]byte(args[0]), &options)
+		}
+		if err != nil {
+			return shim.Error("Error parsing settings json")
+		}
+		settings.Migrations = stored.Migrations
+
+		if initialized && settings.Admin != stored.Admin && !options.ChangeAdmin {
+			return shim.Error("The admin is " + stored.Admin + ", set changeAdmin to hand it to " + settings.Admin)
+		}
+	}
 
+	err = validateSettings(settings)
 	if err != nil {
-		return shim.Error("Error parsing settings json")
+		return shim.Error(err.Error())
+	}
+
+	err = t.migrate(stub, &settings, initialized)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	settings.Version = ChaincodeVersion
 
-	err = stub.PutState(KeySettings, []byte(args[0]))
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return shim.Error("Error marshaling settings")
+	}
+
+	err = stub.PutState(KeySettings, data)
 	if err != nil {
 		return shim.Error("Error saving token data")
 	}
 
-	return shim.Success(nil)
+	return shim.Success(data)
 }
 
 func (t *CounterfeitCC) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
+	// collects the events of this transaction into one envelope
+	stub = newEventStub(stub)
+
+	err := t.authorize(stub, function)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// call routing
 	switch function {
 	case "info":
@@ -115,14 +221,110 @@ func (t *CounterfeitCC) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Success(info)
 	case "createUser":
 		return t.registerUser(stub, args)
+	case "approveUser":
+		return t.changeUserStatus(stub, args, UserRequested, UserApproved)
+	case "rejectUser":
+		return t.changeUserStatus(stub, args, UserRequested, UserRejected)
+	case "suspendUser":
+		return t.changeUserStatus(stub, args, UserApproved, UserSuspended)
+	case "reinstateUser":
+		return t.changeUserStatus(stub, args, UserSuspended, UserApproved)
+	case "getUser":
+		return t.getUser(stub, args)
+	case "listUsers":
+		return t.listUsers(stub, args)
 	case "createCarton":
 		return t.registerCarton(stub, args)
-	case "sellCarton":
+	case "createCartons":
+		return t.createCartons(stub, args)
+	case "sellCarton", "offerTransfer":
 		return t.sellCarton(stub, args)
+	case "sellCartons":
+		return t.sellCartons(stub, args)
+	case "transferPackages":
+		return t.transferPackages(stub, args)
+	case "acceptTransfer":
+		return t.acceptTransfer(stub, args)
+	case "rejectTransfer":
+		return t.rejectTransfer(stub, args)
+	case "cancelTransfer":
+		return t.cancelTransfer(stub, args)
+	case "getTransfer":
+		return t.getTransferOffer(stub, args)
+	case "listTransfers":
+		return t.listTransfers(stub, args)
 	case "sellPackage":
 		return t.sellPackage(stub, args)
 	case "getPackageHistory":
 		return t.getPackageHistory(stub, args)
+	case "getCartonHistory":
+		return t.cartonHistory(stub, args)
+	case "exportEpcis":
+		return t.exportEpcis(stub, args)
+	case "verifyPackage":
+		return t.verifyPackage(stub, args)
+	case "lookupSgtin":
+		return t.lookupSgtin(stub, args)
+	case "listExpiringCartons":
+		return t.listExpiringCartons(stub, args)
+	case "listMyCartons":
+		return t.listMyCartons(stub, args)
+	case "getCarton":
+		return t.getCartonDetails(stub, args)
+	case "listPackages":
+		return t.listPackages(stub, args)
+	case "createContainer":
+		return t.createContainer(stub, args)
+	case "aggregate":
+		return t.aggregate(stub, args)
+	case "disaggregate":
+		return t.disaggregate(stub, args)
+	case "getContainer":
+		return t.getContainerContents(stub, args)
+	case "issueRecall":
+		return t.issueRecall(stub, args)
+	case "getRecall":
+		return t.getRecall(stub, args)
+	case "listRecalls":
+		return t.listRecalls(stub, args)
+	case "requestReturn":
+		return t.requestReturn(stub, args)
+	case "acceptReturn":
+		return t.acceptReturn(stub, args)
+	case "rejectReturn":
+		return t.rejectReturn(stub, args)
+	case "completeReturn":
+		return t.completeReturn(stub, args)
+	case "getReturn":
+		return t.getReturnRequest(stub, args)
+	case "listReturns":
+		return t.listReturns(stub, args)
+	case "registerSite":
+		return t.registerSite(stub, args)
+	case "getSite":
+		return t.getSiteDetails(stub, args)
+	case "getRoute":
+		return t.getRoute(stub, args)
+	case "listAlerts":
+		return t.listAlerts(stub, args)
+	case "triageAlert":
+		return t.triageAlert(stub, args)
+	case "registerKey":
+		return t.registerKey(stub, args)
+	case "revokeKey":
+		return t.revokeKey(stub, args)
+	case "getProducerKeys":
+		return t.listProducerKeys(stub, args)
+	case "signPackages":
+		return t.signPackages(stub, args)
+	case "registerSensor":
+		return t.registerSensor(stub, args)
+	case "submitReadings":
+		return t.submitReadings(stub, args)
+	case "getColdChain":
+		return t.coldChain(stub, args)
+	case "releaseQuarantine":
+		return t.releaseQuarantine(stub, args)
 	default:
 		return shim.Error("Incorrect function name: " + function)
 	}
@@ -153,6 +355,26 @@ func (t *CounterfeitCC) registerUser(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("Error extracting user identity")
 	}
 
+	_, err = userIndex(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a rejected participant may ask again, everybody else is already known
+	user, err := t.findUser(stub, caller)
+	if err == nil && user.Status != UserRejected {
+		return shim.Error("User '" + caller + "' is already registered")
+	}
+
+	if err == nil && user.Role != args[0] {
+		prefix, _ := userIndex(user.Role)
+		key, _ := stub.CreateCompositeKey(prefix, []string{caller})
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error("Error removing rejected user '" + caller + "'")
+		}
+	}
+
 	err = t.createUser(stub, caller, args[0])
 
 	if err != nil {
@@ -162,15 +384,118 @@ func (t *CounterfeitCC) registerUser(stub shim.ChaincodeStubInterface, args []st
 	return shim.Success(nil)
 }
 
+func (t *CounterfeitCC) getUser(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.findUser(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(user)
+	if err != nil {
+		return shim.Error("Error generating user response")
+	}
+
+	return shim.Success(data)
+}
+
+// listUsers returns the participants of all roles or, given a role argument, of that role only
+func (t *CounterfeitCC) listUsers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("expected at most 1 argument")
+	}
+
+	roles := Roles
+	if len(args) == 1 && args[0] != "" {
+		_, err := userIndex(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		roles = []string{args[0]}
+	}
+
+	var result []User = []User{}
+	for _, role := range roles {
+		prefix, _ := userIndex(role)
+		iter, err := stub.GetStateByPartialCompositeKey(prefix, []string{})
+		if err != nil {
+			return shim.Error("Error listing users: " + err.Error())
+		}
+
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return shim.Error("Error listing users: " + err.Error())
+			}
+
+			user := User{}
+			err = json.Unmarshal(kv.Value, &user)
+			if err != nil {
+				iter.Close()
+				return shim.Error("Error parsing user json: " + err.Error())
+			}
+
+			if user.Status == "" {
+				user.Status = UserRequested
+			}
+
+			result = append(result, user)
+		}
+		iter.Close()
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating user list response")
+	}
+
+	return shim.Success(data)
+}
+
+// changeUserStatus moves a participant from one registry status to another, only the admin may do that
+func (t *CounterfeitCC) changeUserStatus(stub shim.ChaincodeStubInterface, args []string, from string, to string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	err := t.checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	user, err := t.findUser(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if user.Status != from {
+		return shim.Error("User '" + user.Name + "' is " + user.Status + ", expected " + from)
+	}
+
+	user.Status = to
+
+	err = t.putUser(stub, user)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
 func (t *CounterfeitCC) registerCarton(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("expected 1 argument")
 	}
 
-	caller, err := CallerCN(stub)
+	user, err := t.activeUser(stub)
 	if err != nil {
-		return shim.Error("Error extracting user identity")
+		return shim.Error(err.Error())
 	}
+	caller := user.Name
 
 	carton := Carton{}
 	err = json.Unmarshal([]byte(args[0]), &carton)
@@ -178,18 +503,24 @@ func (t *CounterfeitCC) registerCarton(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Error parsing carton json")
 	}
 
-	carton.Producer = caller
-	carton.Id = uintToString(uint64Random())
-	carton.ProductionDate = time.Now()
+	ids := newIdGenerator(stub)
 
-	packages, err := t.createCarton(stub, carton.Id, carton)
+	carton, err = t.prepareCarton(stub, ids, caller, carton)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	packages, err := t.createCarton(stub, ids, carton)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	response := CreateCartonResponse{
 		Carton: carton,
 		PackageList: *packages,
 	}
 
-	data, _ := json.Marshal(response)
+	data, err := json.Marshal(response)
 	if err != nil {
 		return shim.Error("Error generating response")
 	}
@@ -198,14 +529,15 @@ func (t *CounterfeitCC) registerCarton(stub shim.ChaincodeStubInterface, args []
 }
 
 
+// sellCarton offers the carton to the buyer, it changes hands once the buyer accepts
 func (t *CounterfeitCC) sellCarton(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("expected 1 argument")
 	}
 
-	caller, err := CallerCN(stub)
+	user, err := t.activeUser(stub)
 	if err != nil {
-		return shim.Error("Error extracting user identity")
+		return shim.Error(err.Error())
 	}
 
 	sellCarton := CartonRef{}
@@ -214,21 +546,17 @@ func (t *CounterfeitCC) sellCarton(stub shim.ChaincodeStubInterface, args []stri
 		return shim.Error("Error parsing sellCarton request json")
 	}
 
-	carton, err := t.getCarton(stub, sellCarton.CartonId)
+	offer, err := t.offerTransfer(stub, newIdGenerator(stub), user, sellCarton)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	if carton.Owner != caller {
-		return shim.Error("Carton doesn't belong to you!")
-	}
-
-	err = t.updateCartonOwner(stub, sellCarton.CartonId, sellCarton.Buyer)
+	data, err := json.Marshal(offer)
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Error generating transfer offer response")
 	}
 
-	return shim.Success(nil)
+	return shim.Success(data)
 }
 
 func (t *CounterfeitCC) sellPackage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -236,27 +564,83 @@ func (t *CounterfeitCC) sellPackage(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("expected 1 argument")
 	}
 
-	caller, err := CallerCN(stub)
+	user, err := t.activeUser(stub)
 	if err != nil {
-		return shim.Error("Error extracting user identity")
+		return shim.Error(err.Error())
 	}
+	caller := user.Name
 
-	sellPackage := PackageRef{}
-	err = json.Unmarshal([]byte(args[0]), &sellPackage)
+	sellPackage, err := parsePackageRef(args[0])
 	if err != nil {
 		return shim.Error("Error parsing sellPackage request json")
 	}
 
+	sellPackage, err = t.resolvePackageRef(stub, sellPackage)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	carton, err := t.getCarton(stub, sellPackage.CartonId)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	if carton.Owner != caller {
-		return shim.Error("Carton doesn't belong to you!")
+	pckg, err := t.getPackage(stub, sellPackage.CartonId, sellPackage.PackageId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if packageOwner(carton, pckg) != caller {
+		return shim.Error("Package doesn't belong to you!")
+	}
+
+	err = t.checkNotRecalled(stub, sellPackage.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = checkNotExpired(stub, carton)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNotQuarantined(stub, sellPackage.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// alerts don't stop the sale, they are for the producer to follow up
+	geo, country, err := t.eventLocation(stub, caller, sellPackage.Site, nil)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ctx, err := t.newRuleContext(stub, TriggerSale, caller, sellPackage, geo, country)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	err = t.markPackageSold(stub, sellPackage.CartonId, sellPackage.PackageId)
+	_, err = t.runRules(stub, ctx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.transitionPackage(stub, sellPackage.CartonId, pckg, PackageDispensed)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.recordStop(stub, sellPackage.CartonId, StopSold, caller, sellPackage.Site, []string{sellPackage.PackageId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitEvent(stub, Event{
+		Type:      EventPackageSold,
+		Actor:     caller,
+		CartonId:  sellPackage.CartonId,
+		PackageId: sellPackage.PackageId,
+	})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -269,10 +653,14 @@ func (t *CounterfeitCC) getPackageHistory(stub shim.ChaincodeStubInterface, args
 		return shim.Error("expected 1 argument")
 	}
 
-	packageRef := PackageRef{}
-	err := json.Unmarshal([]byte(args[0]), &packageRef)
+	packageRef, err := parsePackageRef(args[0])
 	if err != nil {
-		return shim.Error("Error parsing sellPackage request json")
+		return shim.Error("Error parsing getPackageHistory request json")
+	}
+
+	packageRef, err = t.resolvePackageRef(stub, packageRef)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	carton, err := t.getCarton(stub, packageRef.CartonId)
@@ -285,19 +673,37 @@ func (t *CounterfeitCC) getPackageHistory(stub shim.ChaincodeStubInterface, args
 		return shim.Error(err.Error())
 	}
 
-	key, _ := stub.CreateCompositeKey(IndexCartons, []string{packageRef.CartonId})
-	history, err := t.getHistory(stub, key)
+	history, err := t.getOwnerHistory(stub, packageRef.CartonId, packageRef.PackageId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	containment, err := t.getContainment(stub, packageRef.CartonId)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	cartonReturns, err := t.getCartonReturns(stub, packageRef.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var returns []ReturnRequest = []ReturnRequest{}
+	for _, request := range cartonReturns {
+		if contains(request.PackageIds, pckg.Id) {
+			returns = append(returns, request)
+		}
+	}
+
 	response := PackageHistoryResponse{
 		Carton: carton,
 		Package: pckg,
-		OwnerHistory: history,
+		OwnerHistory: markReturns(history, returns),
+		Containment: containment,
+		Returns: returns,
 	}
 
-	data, _ := json.Marshal(response)
+	data, err := json.Marshal(response)
 	if err != nil {
 		return shim.Error("Error generating package history response")
 	}
@@ -306,37 +712,49 @@ func (t *CounterfeitCC) getPackageHistory(stub shim.ChaincodeStubInterface, args
 }
 
 // ------------------------------------------------------------------
-func (t *CounterfeitCC) getHistory(stub shim.ChaincodeStubInterface, key string) ([]HistoryEntry, error) {
-
-	historyIer, err := stub.GetHistoryForKey(key)
+// prepareCarton fills in what the chaincode decides for a new carton and validates it
+func (t *CounterfeitCC) prepareCarton(stub shim.ChaincodeStubInterface, ids *idGenerator, producer string, carton Carton) (Carton, error) {
+	var err error
 
+	carton.Producer = producer
+	carton.Owner = producer
+	carton.Id, err = ids.nextFree(IndexCartons)
 	if err != nil {
-		return nil, err
+		return Carton{}, err
+	}
+	carton.ProductionDate, err = txTime(stub)
+	if err != nil {
+		return Carton{}, err
 	}
 
-	var history []HistoryEntry = []HistoryEntry{}
-	for i := 0; historyIer.HasNext(); i++ {
-		modification, err := historyIer.Next()
-		if err != nil {
-			return nil, err
-		}
+	err = validateCarton(carton)
+	if err != nil {
+		return Carton{}, err
+	}
 
-		historyEntry := &HistoryEntry{
-			TxId: modification.TxId,
-			Timestamp: modification.Timestamp.Seconds,
-			Owner:   string(modification.Value),
-		}
+	err = t.checkSite(stub, carton.Site, producer)
+	if err != nil {
+		return Carton{}, err
+	}
 
-		history = append(history, *historyEntry)
+	// without serials the packages get generated ids
+	carton.Serialized = carton.Serials != nil
+	if carton.Serialized {
+		err = validateSerials(ids, carton)
 	}
 
-	return history, nil
+	return carton, err
 }
-// ------------------------------------------------------------------
-func (t *CounterfeitCC) createCarton(stub shim.ChaincodeStubInterface, id string, carton Carton) (*[]Package, error) {
 
+func (t *CounterfeitCC) createCarton(stub shim.ChaincodeStubInterface, ids *idGenerator, carton Carton) (*[]Package, error) {
+
+	id := carton.Id
 	key, _ := stub.CreateCompositeKey(IndexCartons, []string{id})
 
+	// the serials are kept as the package ids
+	serials := carton.Serials
+	carton.Serials = nil
+
 	data, err := json.Marshal(carton)
 	if err != nil {
 		return nil, errors.New("Error marshaling carton object'" + id + "': " + err.Error())
@@ -345,18 +763,45 @@ func (t *CounterfeitCC) createCarton(stub shim.ChaincodeStubInterface, id string
 	err = stub.PutState(key, []byte(data))
 
 	if err != nil {
-		return nil, errors.New("Error creating user '" + id + "': " + err.Error())
+		return nil, errors.New("Error creating carton '" + id + "': " + err.Error())
+	}
+
+	err = t.indexCartonOwner(stub, id, "", carton.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, Event{Type: EventCartonCreated, Actor: carton.Producer, CartonId: id})
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.recordStop(stub, id, StopCreated, carton.Producer, carton.Site, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	var result []Package = []Package{}
 	for i := 0; i < carton.PackageNum; i++ {
 
+		var packageId string
+		if carton.Serialized {
+			packageId = serials[i]
+			err = t.putSgtin(stub, carton.Gtin, PackageRef{CartonId: id, PackageId: packageId})
+		} else {
+			packageId, err = ids.nextFree(IndexPackage, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
 		pckg := Package{
-			Id: uintToString(uint64Random()),
+			Id: packageId,
+			State: PackageCreated,
 			Sold: false,
 		}
 
-		err := t.createPackage(stub, id, pckg.Id, pckg)
+		err = t.createPackage(stub, id, pckg.Id, pckg)
 		if err != nil {
 			return nil, err
 		}
@@ -417,20 +862,102 @@ func (t *CounterfeitCC) getPackage(stub shim.ChaincodeStubInterface, cartonId st
 	if err != nil {
 		return Package{}, errors.New("Error parsing package json: " + err.Error())
 	}
+	migratePackage(&pckg)
 
 	return pckg, nil
 }
 
+// findCartons scans all cartons for the ones matching the filter
+func (t *CounterfeitCC) findCartons(stub shim.ChaincodeStubInterface, filter func(Carton) bool) ([]Carton, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexCartons, []string{})
+	if err != nil {
+		return nil, errors.New("Error getting cartons: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []Carton = []Carton{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading cartons: " + err.Error())
+		}
+
+		carton := Carton{}
+		err = json.Unmarshal(kv.Value, &carton)
+		if err != nil {
+			return nil, errors.New("Error parsing carton json: " + err.Error())
+		}
+
+		if filter(carton) {
+			result = append(result, carton)
+		}
+	}
+
+	return result, nil
+}
+
+func (t *CounterfeitCC) getProducerCartons(stub shim.ChaincodeStubInterface, producer string) ([]Carton, error) {
+	return t.findCartons(stub, func(carton Carton) bool {
+		return carton.Producer == producer
+	})
+}
+
+// packageOwner returns who holds the package: its own owner or else the carton owner
+func packageOwner(carton Carton, pckg Package) string {
+	if pckg.Owner != "" {
+		return pckg.Owner
+	}
+
+	return carton.Owner
+}
+
+func (t *CounterfeitCC) getCartonPackages(stub shim.ChaincodeStubInterface, cartonId string) ([]Package, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexPackage, []string{cartonId})
+	if err != nil {
+		return nil, errors.New("Error getting packages: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []Package = []Package{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading packages: " + err.Error())
+		}
+
+		pckg := Package{}
+		err = json.Unmarshal(kv.Value, &pckg)
+		if err != nil {
+			return nil, errors.New("Error parsing package json: " + err.Error())
+		}
+		migratePackage(&pckg)
+
+		result = append(result, pckg)
+	}
+
+	return result, nil
+}
+
 func (t *CounterfeitCC) updateCartonOwner(stub shim.ChaincodeStubInterface, cartonId string, newOwner string) error {
 	carton, err := t.getCarton(stub, cartonId)
 	if err != nil {
 		return err
 	}
 
-	key, _ := stub.CreateCompositeKey(IndexCartons, []string{cartonId})
-
+	oldOwner := carton.Owner
 	carton.Owner = newOwner
 
+	err = t.putCarton(stub, carton)
+	if err != nil {
+		return err
+	}
+
+	return t.indexCartonOwner(stub, carton.Id, oldOwner, newOwner)
+}
+
+func (t *CounterfeitCC) putCarton(stub shim.ChaincodeStubInterface, carton Carton) error {
+	key, _ := stub.CreateCompositeKey(IndexCartons, []string{carton.Id})
+
 	data, err := json.Marshal(carton)
 	if err != nil {
 		return errors.New("Error marshaling carton object: " + err.Error())
@@ -444,84 +971,118 @@ func (t *CounterfeitCC) updateCartonOwner(stub shim.ChaincodeStubInterface, cart
 	return nil
 }
 
-func (t *CounterfeitCC) markPackageSold(stub shim.ChaincodeStubInterface, cartonId string, packageId string) error {
-	pckg, err := t.getPackage(stub, cartonId, packageId)
+// ------------------------------------------------------------------
+func userIndex(role string) (string, error) {
+	switch role {
+	case RoleProducer:
+		return IndexProducer, nil
+	case RolePharmacy:
+		return IndexPharmacy, nil
+	case RoleReseller:
+		return IndexReseller, nil
+	default:
+		return "", errors.New("Unknown user role '" + role + "'")
+	}
+}
+
+func (t *CounterfeitCC) createUser(stub shim.ChaincodeStubInterface, cn string, role string) error {
+	user := User{
+		Name: cn,
+		Role: role,
+		Status: UserRequested,
+	}
+
+	return t.putUser(stub, user)
+}
+
+func (t *CounterfeitCC) putUser(stub shim.ChaincodeStubInterface, user User) error {
+	prefix, err := userIndex(user.Role)
 	if err != nil {
 		return err
 	}
 
-	pckg.Sold = true
-	pckg.SellDate = time.Now()
+	key, _ := stub.CreateCompositeKey(prefix, []string{user.Name})
 
-	key, _ := stub.CreateCompositeKey(IndexPackage, []string{cartonId, packageId})
-
-	data, err := json.Marshal(pckg)
+	data, err := json.Marshal(user)
 	if err != nil {
-		return errors.New("Error marshaling package object: " + err.Error())
+		return errors.New("Error marshaling user object'" + user.Name + "' with the role '" + user.Role + "': " + err.Error())
 	}
-	err = stub.PutState(key, data)
+
+	err = stub.PutState(key, []byte(data))
 
 	if err != nil {
-		return errors.New("Error storing package: " + err.Error())
+		return errors.New("Error storing user '" + user.Name + "' with the role '" + user.Role + "': " + err.Error())
 	}
 
 	return nil
 }
-// ------------------------------------------------------------------
-func (t *CounterfeitCC) userExists(stub shim.ChaincodeStubInterface, cn string, role string) bool {
-	var prefix string
-	switch role {
-	case "producer":
-		prefix = IndexProducer
-	case "pharmacy":
-		prefix = IndexPharmacy
-	case "reseller":
-		prefix = IndexReseller
-	default:
-		return false
-	}
 
-	key, _ := stub.CreateCompositeKey(prefix, []string{cn})
+// findUser looks the participant up in every role index, a participant holds one role only
+func (t *CounterfeitCC) findUser(stub shim.ChaincodeStubInterface, cn string) (User, error) {
+	for _, role := range Roles {
+		prefix, _ := userIndex(role)
+		key, _ := stub.CreateCompositeKey(prefix, []string{cn})
 
-	data, err := stub.GetState(key)
-	if err != nil {
-		return false
-	} else if data == nil {
-		return false
+		data, err := stub.GetState(key)
+		if err != nil {
+			return User{}, errors.New("Error getting user: " + err.Error())
+		} else if data == nil {
+			continue
+		}
+
+		user := User{}
+		err = json.Unmarshal(data, &user)
+		if err != nil {
+			return User{}, errors.New("Error parsing user json: " + err.Error())
+		}
+
+		// users registered before the approval workflow have no status and need to be approved
+		if user.Status == "" {
+			user.Status = UserRequested
+		}
+
+		return user, nil
 	}
 
-	return true
+	return User{}, errors.New("User '" + cn + "' is not registered")
 }
 
-func (t *CounterfeitCC) createUser(stub shim.ChaincodeStubInterface, cn string, role string) error {
-	var prefix string
-	switch role {
-	case "producer":
-		prefix = IndexProducer
-	case "pharmacy":
-		prefix = IndexPharmacy
-	case "reseller":
-		prefix = IndexReseller
-	default:
-		return errors.New("Unknown user roll")
+// activeUser returns the calling participant if the admin approved it and it isn't suspended.
+// Every state-changing function except the registration request goes through here.
+func (t *CounterfeitCC) activeUser(stub shim.ChaincodeStubInterface) (User, error) {
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return User{}, errors.New("Error extracting user identity")
 	}
 
-	key, _ := stub.CreateCompositeKey(prefix, []string{cn})
+	user, err := t.findUser(stub, caller)
+	if err != nil {
+		return User{}, err
+	}
 
-	user := User{
-		Name: cn,
-		Role: role,
+	switch user.Status {
+	case UserApproved:
+		return user, nil
+	case UserSuspended:
+		return User{}, errors.New("User '" + caller + "' is suspended")
+	default:
+		return User{}, errors.New("User '" + caller + "' is not approved")
 	}
+}
 
-	data, err := json.Marshal(user)
+func (t *CounterfeitCC) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	caller, err := CallerCN(stub)
 	if err != nil {
-		return errors.New("Error marshaling user object'" + cn + "' with the role '" + role + "': " + err.Error())
+		return errors.New("Error extracting user identity")
 	}
 
-	err = stub.PutState(key, []byte(data))
-
+	settings, err := t.getSettings(stub)
 	if err != nil {
-		return errors.New("Error creating user '" + cn + "' with the role '" + role + "': " + err.Error())
+		return errors.New("Error getting settings: " + err.Error())
+	}
+
+	if settings.Admin == "" || settings.Admin != caller {
+		return errors.New("Only the admin can do this")
 	}
 
 	return nil
@@ -546,28 +1107,112 @@ func CNFromX509(certPEM string) (string, error) {
 	return cert.Subject.CommonName, nil
 }
 
-// extracts CN from caller of a chaincode function
-func CallerCN(stub shim.ChaincodeStubInterface) (string, error) {
+// extracts the enrollment certificate of the caller of a chaincode function
+func CallerCert(stub shim.ChaincodeStubInterface) (*x509.Certificate, error) {
 	data, _ := stub.GetCreator()
 	serializedId := msp.SerializedIdentity{}
 	err := proto.Unmarshal(data, &serializedId)
 	if err != nil {
-		return "", errors.New("Could not unmarshal Creator")
+		return nil, errors.New("Could not unmarshal Creator")
+	}
+
+	cert, err := parsePEM(string(serializedId.IdBytes))
+	if err != nil {
+		return nil, errors.New("Failed to parse certificate: " + err.Error())
 	}
+	return cert, nil
+}
 
-	cn, err := CNFromX509(string(serializedId.IdBytes))
+// extracts CN from caller of a chaincode function
+func CallerCN(stub shim.ChaincodeStubInterface) (string, error) {
+	cert, err := CallerCert(stub)
 	if err != nil {
 		return "", err
 	}
-	return cn, nil
+	return cert.Subject.CommonName, nil
+}
+
+// txTime is the chaincode clock. Every date stored or compared on the ledger
+// must come from here and never from time.Now(): it returns the timestamp the
+// client put into the proposal, which is the same on every endorsing peer.
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Error getting transaction timestamp: " + err.Error())
+	} else if ts == nil {
+		return time.Time{}, errors.New("Transaction has no timestamp")
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
 }
 
 func uintToString(num uint64) (string) {
 	return strconv.FormatUint(num, 10)
 }
 
-func uint64Random() uint64 {
-	return uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
+// idGenerator mints ids from the transaction id and a per-transaction counter,
+// so every endorsing peer derives the same ids for the same proposal.
+type idGenerator struct {
+	stub    shim.ChaincodeStubInterface
+	counter uint64
+	issued  map[string]bool
+}
+
+func newIdGenerator(stub shim.ChaincodeStubInterface) *idGenerator {
+	return &idGenerator{
+		stub:   stub,
+		issued: map[string]bool{},
+	}
+}
+
+// next returns the first 8 bytes of sha256(txId:counter) as a decimal string
+func (g *idGenerator) next() string {
+	hash := sha256.Sum256([]byte(g.stub.GetTxID() + ":" + uintToString(g.counter)))
+	g.counter++
+	return uintToString(binary.BigEndian.Uint64(hash[:8]))
+}
+
+// claim reserves a key that must not exist yet, on the ledger or earlier in this transaction
+func (g *idGenerator) claim(key string) error {
+	if g.issued[key] {
+		return errors.New("Key is already taken in this transaction")
+	}
+
+	data, err := g.stub.GetState(key)
+	if err != nil {
+		return errors.New("Error checking key: " + err.Error())
+	} else if data != nil {
+		return errors.New("Key is already taken")
+	}
+
+	g.issued[key] = true
+	return nil
+}
+
+// nextFree returns the next id that is neither stored under the composite key
+// (index, attributes..., id) nor already issued in this transaction. The
+// issued set matters because GetState doesn't see writes of the running
+// transaction.
+func (g *idGenerator) nextFree(index string, attributes ...string) (string, error) {
+	for i := 0; i < MaxIdAttempts; i++ {
+		id := g.next()
+		if g.issued[id] {
+			continue
+		}
+
+		key, _ := g.stub.CreateCompositeKey(index, append(append([]string{}, attributes...), id))
+		data, err := g.stub.GetState(key)
+		if err != nil {
+			return "", errors.New("Error checking id '" + id + "': " + err.Error())
+		} else if data != nil {
+			continue
+		}
+
+		g.issued[id] = true
+		return id, nil
+	}
+
+	return "", errors.New("Could not generate a free id under " + index)
 }
 
 // ------------------------------------------------------------------
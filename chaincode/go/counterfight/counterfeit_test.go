@@ -1,12 +1,25 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"time"
 	// "errors"
+	"counterfight/tagcode"
 	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"./mock"
-	"./testdata"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"counterfight/mock"
+	"counterfight/testdata"
 	"testing"
 )
 
@@ -47,3 +60,2203 @@ func TestInitToken(t *testing.T) {
 	initToken(t)
 }
 
+
+func invoke(stub *mock.FullMockStub, txId string, function string, args ...string) pb.Response {
+	return stub.MockInvoke(txId, util.ToChaincodeArgs(append([]string{function}, args...)...))
+}
+
+// addUser requests the role as the certificate's user, approves it as the admin
+// and leaves the stub calling as that user
+func addUser(t *testing.T, stub *mock.FullMockStub, cn string, cert string, role string) {
+	stub.MockCreator("default", cert)
+	res := invoke(stub, "register-" + cn, "createUser", role)
+	if res.Status != shim.OK {
+		t.Fatal("createUser failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	res = invoke(stub, "approve-" + cn, "approveUser", cn)
+	if res.Status != shim.OK {
+		t.Fatal("approveUser failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", cert)
+}
+
+// testCarton returns carton data that passes validation and expires in a year
+func testCarton(name string, packageNum int) Carton {
+	return Carton{
+		Name:       name,
+		PackageNum: packageNum,
+		Gtin:       "04012345678901",
+		Lot:        "L-" + name,
+		ExpiryDate: mock.DefaultTxTime.AddDate(1, 0, 0),
+	}
+}
+
+func createCarton(t *testing.T, stub *mock.FullMockStub, txId string, carton Carton) CreateCartonResponse {
+	cartonBytes, _ := json.Marshal(carton)
+	res := stub.MockInvoke(txId, util.ToChaincodeArgs("createCarton", string(cartonBytes)))
+	if res.Status != shim.OK {
+		t.Fatal("createCarton failed: " + res.Message)
+	}
+
+	response := CreateCartonResponse{}
+	err := json.Unmarshal(res.Payload, &response)
+	if err != nil {
+		t.Fatal("Could not parse createCarton response")
+	}
+
+	return response
+}
+
+// initChain registers testUser as pharmacy, testUser3 as reseller and
+// testUser2 as producer and leaves the stub calling as the producer
+func initChain(t *testing.T) *mock.FullMockStub {
+	stub := initToken(t)
+	addUser(t, stub, testdata.TestUser1CN, testdata.TestUser1Cert, RolePharmacy)
+	addUser(t, stub, testdata.TestUser3CN, testdata.TestUser3Cert, RoleReseller)
+	addUser(t, stub, testdata.TestUser2CN, testdata.TestUser2Cert, RoleProducer)
+	return stub
+}
+
+// transferCarton offers the carton as the seller, accepts it as the buyer and
+// leaves the stub calling as the buyer
+func transferCarton(t *testing.T, stub *mock.FullMockStub, txId string, cartonId string, sellerCert string, buyerCN string, buyerCert string) TransferOffer {
+	stub.MockCreator("default", sellerCert)
+	ref, _ := json.Marshal(CartonRef{CartonId: cartonId, Buyer: buyerCN})
+	res := invoke(stub, txId + "-offer", "sellCarton", string(ref))
+	if res.Status != shim.OK {
+		t.Fatal("sellCarton failed: " + res.Message)
+	}
+
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	stub.MockCreator("default", buyerCert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+	res = invoke(stub, txId, "acceptTransfer", string(transferRef))
+	if res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	json.Unmarshal(res.Payload, &offer)
+	return offer
+}
+
+func TestCreateCartonDeterministicIds(t *testing.T) {
+	stub1 := initToken(t)
+	stub2 := initToken(t)
+	addUser(t, stub1, testdata.TestUser2CN, testdata.TestUser2Cert, RoleProducer)
+	addUser(t, stub2, testdata.TestUser2CN, testdata.TestUser2Cert, RoleProducer)
+
+	carton := testCarton("Aspirin", 3)
+	res1 := createCarton(t, stub1, "tx1", carton)
+	res2 := createCarton(t, stub2, "tx1", carton)
+
+	if res1.Carton.Id != res2.Carton.Id {
+		t.Error("Carton ids differ between stubs: " + res1.Carton.Id + " != " + res2.Carton.Id)
+	}
+
+	if len(res1.PackageList) != 3 {
+		t.Fatal("Expected 3 packages")
+	}
+
+	if !reflect.DeepEqual(stub1.WriteSet(), stub2.WriteSet()) {
+		t.Error("Write sets differ between stubs for the same proposal")
+	}
+
+	res3 := createCarton(t, stub1, "tx2", carton)
+	if res3.Carton.Id == res1.Carton.Id {
+		t.Error("Different transactions produced the same carton id")
+	}
+}
+
+func TestIdGeneratorSkipsExistingKeys(t *testing.T) {
+	stub := initToken(t)
+
+	stub.MockTransactionStart("tx1")
+	taken := newIdGenerator(stub).next()
+	key, _ := stub.CreateCompositeKey(IndexCartons, []string{taken})
+	stub.PutState(key, []byte("{}"))
+
+	id, err := newIdGenerator(stub).nextFree(IndexCartons)
+	stub.MockTransactionEnd("tx1")
+
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if id == taken {
+		t.Error("Id generator returned an id that is already stored")
+	}
+}
+
+func TestDatesComeFromTxTimestamp(t *testing.T) {
+	stub := initToken(t)
+	addUser(t, stub, testdata.TestUser2CN, testdata.TestUser2Cert, RoleProducer)
+
+	created := time.Date(2017, time.March, 14, 9, 30, 0, 500, time.UTC)
+	stub.MockTxTimestamp(created)
+	res := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+
+	if !res.Carton.ProductionDate.Equal(created) {
+		t.Error("Production date is not the transaction timestamp: " + res.Carton.ProductionDate.String())
+	}
+
+	carton, err := (&CounterfeitCC{}).getCarton(stub, res.Carton.Id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !carton.ProductionDate.Equal(created) {
+		t.Error("Stored production date is not the transaction timestamp")
+	}
+}
+
+func TestUserRegistryLifecycle(t *testing.T) {
+	stub := initToken(t)
+	carton, _ := json.Marshal(testCarton("Aspirin", 1))
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res := invoke(stub, "tx1", "createUser", RoleProducer); res.Status != shim.OK {
+		t.Fatal("createUser failed: " + res.Message)
+	}
+
+	if res := invoke(stub, "tx2", "createCarton", string(carton)); res.Status == shim.OK {
+		t.Error("Unapproved user could create a carton")
+	}
+
+	if res := invoke(stub, "tx3", "approveUser", testdata.TestUser2CN); res.Status == shim.OK {
+		t.Error("Non-admin could approve a user")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx4", "approveUser", testdata.TestUser2CN); res.Status != shim.OK {
+		t.Fatal("approveUser failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res := invoke(stub, "tx5", "createCarton", string(carton)); res.Status != shim.OK {
+		t.Error("Approved user could not create a carton: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx6", "suspendUser", testdata.TestUser2CN); res.Status != shim.OK {
+		t.Fatal("suspendUser failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res := invoke(stub, "tx7", "createCarton", string(carton)); res.Status == shim.OK {
+		t.Error("Suspended user could create a carton")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx8", "reinstateUser", testdata.TestUser2CN); res.Status != shim.OK {
+		t.Fatal("reinstateUser failed: " + res.Message)
+	}
+
+	res := invoke(stub, "tx9", "getUser", testdata.TestUser2CN)
+	user := User{}
+	json.Unmarshal(res.Payload, &user)
+	if user.Role != RoleProducer || user.Status != UserApproved {
+		t.Error("Unexpected user record: " + string(res.Payload))
+	}
+}
+
+func TestRejectedUserCanRequestAgain(t *testing.T) {
+	stub := initToken(t)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	invoke(stub, "tx1", "createUser", RoleProducer)
+	if res := invoke(stub, "tx2", "createUser", RolePharmacy); res.Status == shim.OK {
+		t.Error("User could register twice")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx3", "rejectUser", testdata.TestUser3CN); res.Status != shim.OK {
+		t.Fatal("rejectUser failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res := invoke(stub, "tx4", "createUser", RolePharmacy); res.Status != shim.OK {
+		t.Fatal("Rejected user could not request again: " + res.Message)
+	}
+
+	res := invoke(stub, "tx5", "listUsers")
+	users := []User{}
+	json.Unmarshal(res.Payload, &users)
+	if len(users) != 1 || users[0].Role != RolePharmacy || users[0].Status != UserRequested {
+		t.Error("Unexpected user list: " + string(res.Payload))
+	}
+
+	res = invoke(stub, "tx6", "listUsers", RoleProducer)
+	json.Unmarshal(res.Payload, &users)
+	if len(users) != 0 {
+		t.Error("Expected no producers: " + string(res.Payload))
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	stub := initToken(t)
+	addUser(t, stub, testdata.TestUser3CN, testdata.TestUser3Cert, RoleReseller)
+
+	carton, _ := json.Marshal(testCarton("Aspirin", 1))
+	if res := invoke(stub, "tx1", "createCarton", string(carton)); res.Status == shim.OK {
+		t.Error("Reseller could create a carton")
+	}
+
+	if res := invoke(stub, "tx2", "approveUser", testdata.TestUser3CN); res.Status == shim.OK {
+		t.Error("Reseller could call an admin function")
+	}
+
+	if res := invoke(stub, "tx3", "noSuchFunction"); res.Status == shim.OK {
+		t.Error("Unknown function was accepted")
+	}
+}
+
+func TestSellCartonFlows(t *testing.T) {
+	stub := initChain(t)
+
+	carton := createCarton(t, stub, "tx1", testCarton("Aspirin", 1)).Carton
+
+	sell := func(txId string, buyer string) pb.Response {
+		ref, _ := json.Marshal(CartonRef{CartonId: carton.Id, Buyer: buyer})
+		return invoke(stub, txId, "sellCarton", string(ref))
+	}
+
+	if res := sell("tx2", "nobody"); res.Status == shim.OK {
+		t.Error("Carton was sold to an unregistered buyer")
+	}
+
+	transferCarton(t, stub, "tx3", carton.Id, testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+
+	if res := sell("tx4", testdata.TestUser2CN); res.Status == shim.OK {
+		t.Error("Reseller could sell back to the producer")
+	}
+
+	transferCarton(t, stub, "tx5", carton.Id, testdata.TestUser3Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	if res := sell("tx6", testdata.TestUser2CN); res.Status == shim.OK {
+		t.Error("Pharmacy could sell to the producer")
+	}
+}
+
+func TestPackageHistory(t *testing.T) {
+	stub := initChain(t)
+
+	start := time.Date(2017, time.June, 1, 8, 0, 0, 123, time.UTC)
+	stub.MockTxTimestamp(start)
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 2))
+	ref := PackageRef{CartonId: created.Carton.Id, PackageId: created.PackageList[0].Id}
+
+	stub.MockTxTimestamp(start.Add(time.Hour))
+	transferCarton(t, stub, "tx2", ref.CartonId, testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+
+	stub.MockTxTimestamp(start.Add(2 * time.Hour))
+	transferCarton(t, stub, "tx3", ref.CartonId, testdata.TestUser3Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	stub.MockTxTimestamp(start.Add(3 * time.Hour))
+	packageRef, _ := json.Marshal(ref)
+	if res := invoke(stub, "tx4", "sellPackage", string(packageRef)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	res := invoke(stub, "tx5", "getPackageHistory", string(packageRef))
+	if res.Status != shim.OK {
+		t.Fatal("getPackageHistory failed: " + res.Message)
+	}
+
+	response := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &response)
+
+	expected := []HistoryEntry{
+		{Object: ObjectCarton, Change: ChangeCreated, Owner: testdata.TestUser2CN, TxId: "tx1"},
+		{Object: ObjectPackage, Change: ChangeCreated, Owner: testdata.TestUser2CN, TxId: "tx1"},
+		{Object: ObjectCarton, Change: ChangeTransferred, Owner: testdata.TestUser3CN, TxId: "tx2"},
+		{Object: ObjectPackage, Change: ChangeUpdated, Owner: testdata.TestUser3CN, TxId: "tx2"},
+		{Object: ObjectCarton, Change: ChangeTransferred, Owner: testdata.TestUser1CN, TxId: "tx3"},
+		{Object: ObjectPackage, Change: ChangeSold, Owner: testdata.TestUser1CN, TxId: "tx4"},
+	}
+
+	if len(response.OwnerHistory) != len(expected) {
+		t.Fatal("Unexpected history: " + string(res.Payload))
+	}
+
+	for i, entry := range response.OwnerHistory {
+		if entry.Object != expected[i].Object || entry.Change != expected[i].Change ||
+			entry.Owner != expected[i].Owner || entry.TxId != expected[i].TxId {
+			t.Error("Unexpected history entry: " + entry.TxId + " " + entry.Object + " " + entry.Change + " " + entry.Owner)
+		}
+	}
+
+	if response.OwnerHistory[0].Time.Nanosecond() != 123 {
+		t.Error("History time lost the nanoseconds")
+	}
+}
+
+func TestTransferOfferLifecycle(t *testing.T) {
+	stub := initChain(t)
+
+	carton := createCarton(t, stub, "tx1", testCarton("Aspirin", 1)).Carton
+	offerTo := func(txId string, buyer string, validFor int64) (TransferOffer, pb.Response) {
+		ref, _ := json.Marshal(CartonRef{CartonId: carton.Id, Buyer: buyer, ValidFor: validFor})
+		res := invoke(stub, txId, "offerTransfer", string(ref))
+		offer := TransferOffer{}
+		json.Unmarshal(res.Payload, &offer)
+		return offer, res
+	}
+	transferArg := func(offer TransferOffer) string {
+		ref, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+		return string(ref)
+	}
+
+	offer, res := offerTo("tx2", testdata.TestUser3CN, 0)
+	if res.Status != shim.OK || offer.Status != TransferPending {
+		t.Fatal("offerTransfer failed: " + res.Message)
+	}
+
+	if _, res := offerTo("tx3", testdata.TestUser1CN, 0); res.Status == shim.OK {
+		t.Error("Locked carton could be offered twice")
+	}
+
+	// both sides see the pending offer
+	for _, cert := range []string{testdata.TestUser2Cert, testdata.TestUser3Cert} {
+		stub.MockCreator("default", cert)
+		res = invoke(stub, "tx4", "listTransfers")
+		offers := []TransferOffer{}
+		json.Unmarshal(res.Payload, &offers)
+		if len(offers) != 1 || offers[0].Id != offer.Id {
+			t.Error("Unexpected pending offers: " + string(res.Payload))
+		}
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx5", "acceptTransfer", transferArg(offer)); res.Status == shim.OK {
+		t.Error("Offer was accepted by somebody else than the buyer")
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res := invoke(stub, "tx6", "rejectTransfer", transferArg(offer)); res.Status != shim.OK {
+		t.Fatal("rejectTransfer failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	offer, res = offerTo("tx7", testdata.TestUser1CN, 0)
+	if res.Status != shim.OK {
+		t.Fatal("Carton wasn't released by the rejection: " + res.Message)
+	}
+
+	if res := invoke(stub, "tx8", "cancelTransfer", transferArg(offer)); res.Status != shim.OK {
+		t.Fatal("cancelTransfer failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx9", "acceptTransfer", transferArg(offer)); res.Status == shim.OK {
+		t.Error("Cancelled offer could be accepted")
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	offer, _ = offerTo("tx10", testdata.TestUser1CN, 60)
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Minute))
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx11", "acceptTransfer", transferArg(offer)); res.Status == shim.OK {
+		t.Error("Expired offer could be accepted")
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if _, res := offerTo("tx12", testdata.TestUser3CN, 0); res.Status != shim.OK {
+		t.Error("Expired offer still locks the carton: " + res.Message)
+	}
+
+	stored, _ := (&CounterfeitCC{}).getCarton(stub, carton.Id)
+	if stored.Owner != testdata.TestUser2CN {
+		t.Error("Carton changed hands without an accepted offer")
+	}
+}
+
+func verifyPackage(t *testing.T, stub *mock.FullMockStub, txId string, ref PackageRef) VerificationResult {
+	refBytes, _ := json.Marshal(ref)
+	res := invoke(stub, txId, "verifyPackage", string(refBytes))
+	if res.Status != shim.OK {
+		t.Fatal("verifyPackage failed: " + res.Message)
+	}
+
+	result := VerificationResult{}
+	json.Unmarshal(res.Payload, &result)
+	return result
+}
+
+func TestVerifyPackage(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	ref := PackageRef{CartonId: created.Carton.Id, PackageId: created.PackageList[0].Id}
+
+	result := verifyPackage(t, stub, "tx2", ref)
+	if result.Verdict != VerdictGenuineUnsold || result.Producer != testdata.TestUser2CN || result.ProductName != "Aspirin" {
+		t.Error("Unexpected verification of an unsold package: " + result.Verdict)
+	}
+
+	if result := verifyPackage(t, stub, "tx3", PackageRef{CartonId: ref.CartonId, PackageId: "42"}); result.Verdict != VerdictUnknown {
+		t.Error("Unknown package was not reported as unknown: " + result.Verdict)
+	}
+
+	if len(stub.WriteSet()) != 0 {
+		t.Errorf("Verifying an unknown package wrote %v", stub.WriteSet())
+	}
+
+	transferCarton(t, stub, "tx4", ref.CartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	refBytes, _ := json.Marshal(ref)
+	if res := invoke(stub, "tx5", "sellPackage", string(refBytes)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	// the buyer checks the purchase, somebody else checks the same code again
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if result := verifyPackage(t, stub, "tx6", ref); result.Verdict != VerdictGenuineSold {
+		t.Error("First check after the sale is not genuine-sold: " + result.Verdict)
+	}
+
+	if result := verifyPackage(t, stub, "tx7", ref); result.Verdict != VerdictSuspicious {
+		t.Error("Repeated check after the sale is not suspicious: " + result.Verdict)
+	}
+
+	scans, _ := (&CounterfeitCC{}).getScans(stub, ref)
+	if len(scans) != 3 {
+		t.Error("Expected every verification to be recorded")
+	}
+}
+
+func TestPackageLifecycle(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	ref := PackageRef{CartonId: created.Carton.Id, PackageId: created.PackageList[0].Id}
+	transferCarton(t, stub, "tx2", ref.CartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	cc := &CounterfeitCC{}
+	pckg, _ := cc.getPackage(stub, ref.CartonId, ref.PackageId)
+	if pckg.State != PackageInDistribution {
+		t.Error("Transferred package is not in distribution: " + pckg.State)
+	}
+
+	refBytes, _ := json.Marshal(ref)
+	if res := invoke(stub, "tx3", "sellPackage", string(refBytes)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	if res := invoke(stub, "tx4", "sellPackage", string(refBytes)); res.Status == shim.OK {
+		t.Error("Dispensed package was sold again")
+	}
+
+	pckg, _ = cc.getPackage(stub, ref.CartonId, ref.PackageId)
+	_, err := cc.transitionPackage(stub, ref.CartonId, pckg, PackageDispensed)
+	if _, ok := err.(*TransitionError); !ok {
+		t.Error("Expected a TransitionError for dispensed -> dispensed")
+	}
+
+	pckg.State = PackageDestroyed
+	_, err = cc.transitionPackage(stub, ref.CartonId, pckg, "lost")
+	if _, ok := err.(*UnknownStateError); !ok {
+		t.Error("Expected an UnknownStateError")
+	}
+}
+
+func TestLegacyPackageJson(t *testing.T) {
+	stub := initToken(t)
+
+	stub.MockTransactionStart("tx1")
+	key, _ := stub.CreateCompositeKey(IndexPackage, []string{"1", "2"})
+	stub.PutState(key, []byte(`{"id":"2","sold":true,"sellDate":"2017-01-01T00:00:00Z"}`))
+	stub.MockTransactionEnd("tx1")
+
+	pckg, err := (&CounterfeitCC{}).getPackage(stub, "1", "2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if pckg.State != PackageDispensed || !pckg.Sold {
+		t.Error("Sold legacy package is not dispensed: " + pckg.State)
+	}
+}
+
+func TestRecall(t *testing.T) {
+	stub := initChain(t)
+
+	sold := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	kept := createCarton(t, stub, "tx2", testCarton("Aspirin", 2))
+	other := createCarton(t, stub, "tx3", testCarton("Ibuprofen", 1))
+	transferCarton(t, stub, "tx4", sold.Carton.Id, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	// a single package of a recalled carton was split off to the reseller
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	split, _ := json.Marshal(CartonRef{CartonId: kept.Carton.Id, PackageIds: []string{kept.PackageList[0].Id}, Buyer: testdata.TestUser3CN})
+	res := invoke(stub, "tx4-split", "transferPackages", string(split))
+	splitOffer := TransferOffer{}
+	json.Unmarshal(res.Payload, &splitOffer)
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	splitRef, _ := json.Marshal(TransferRef{TransferId: splitOffer.Id})
+	if res := invoke(stub, "tx4-accept", "acceptTransfer", string(splitRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	recallArg, _ := json.Marshal(Recall{Product: "Aspirin", Severity: SeverityClass1})
+	if res := invoke(stub, "tx5", "issueRecall", string(recallArg)); res.Status == shim.OK {
+		t.Error("Recall without a reason was accepted")
+	}
+
+	recallArg, _ = json.Marshal(Recall{Product: "Aspirin", Severity: SeverityClass1, Reason: "contamination"})
+	res = invoke(stub, "tx6", "issueRecall", string(recallArg))
+	if res.Status != shim.OK {
+		t.Fatal("issueRecall failed: " + res.Message)
+	}
+
+	response := RecallResponse{}
+	json.Unmarshal(res.Payload, &response)
+	if len(response.Recall.Cartons) != 2 || contains(response.Recall.Cartons, other.Carton.Id) {
+		t.Error("Recall covers the wrong cartons: " + string(res.Payload))
+	}
+
+	owners := []string{testdata.TestUser1CN, testdata.TestUser2CN, testdata.TestUser3CN}
+	if !reflect.DeepEqual(response.Owners, owners) {
+		t.Error("Unexpected recall owners: " + string(res.Payload))
+	}
+
+	offer, _ := json.Marshal(CartonRef{CartonId: kept.Carton.Id, Buyer: testdata.TestUser3CN})
+	if res := invoke(stub, "tx7", "sellCarton", string(offer)); res.Status == shim.OK {
+		t.Error("Recalled carton could be offered")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	ref := PackageRef{CartonId: sold.Carton.Id, PackageId: sold.PackageList[0].Id}
+	refBytes, _ := json.Marshal(ref)
+	if res := invoke(stub, "tx8", "sellPackage", string(refBytes)); res.Status == shim.OK {
+		t.Error("Recalled package could be sold")
+	}
+
+	if result := verifyPackage(t, stub, "tx9", ref); result.Verdict != VerdictRecalled {
+		t.Error("Recalled package verified as " + result.Verdict)
+	}
+
+	recallRef, _ := json.Marshal(RecallRef{RecallId: response.Recall.Id})
+	res = invoke(stub, "tx10", "getRecall", string(recallRef))
+	if res.Status != shim.OK {
+		t.Fatal("getRecall failed: " + res.Message)
+	}
+
+	json.Unmarshal(res.Payload, &response)
+	if !reflect.DeepEqual(response.Owners, owners) {
+		t.Error("Unexpected owners of a stored recall: " + string(res.Payload))
+	}
+
+	res = invoke(stub, "tx11", "listRecalls", testdata.TestUser2CN)
+	recalls := []RecallResponse{}
+	json.Unmarshal(res.Payload, &recalls)
+	if len(recalls) != 1 || recalls[0].Recall.Reason != "contamination" {
+		t.Error("Unexpected recall list: " + string(res.Payload))
+	}
+}
+
+func TestCartonValidation(t *testing.T) {
+	stub := initChain(t)
+
+	invalid := map[string]Carton{}
+	carton := testCarton("Aspirin", 1)
+	carton.Gtin = "04012345678902"
+	invalid["wrong check digit"] = carton
+	carton = testCarton("Aspirin", 1)
+	carton.Gtin = "4012345"
+	invalid["short GTIN"] = carton
+	carton = testCarton("Aspirin", 1)
+	carton.Lot = "lot with spaces"
+	invalid["bad lot"] = carton
+	carton = testCarton("Aspirin", 1)
+	carton.ExpiryDate = mock.DefaultTxTime.AddDate(0, 0, -1)
+	invalid["expiry before production"] = carton
+
+	for name, carton := range invalid {
+		cartonBytes, _ := json.Marshal(carton)
+		if res := invoke(stub, "tx1", "createCarton", string(cartonBytes)); res.Status == shim.OK {
+			t.Error("Carton with " + name + " was accepted")
+		}
+	}
+
+	if validateGtin("4006381333931") != nil {
+		t.Error("Valid GTIN-13 was rejected")
+	}
+}
+
+func TestExpiredGoods(t *testing.T) {
+	stub := initChain(t)
+
+	soon := testCarton("Aspirin", 1)
+	soon.ExpiryDate = mock.DefaultTxTime.AddDate(0, 0, 10)
+	created := createCarton(t, stub, "tx1", soon)
+	createCarton(t, stub, "tx2", testCarton("Ibuprofen", 1))
+	transferCarton(t, stub, "tx3", created.Carton.Id, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	res := invoke(stub, "tx4", "listExpiringCartons", `{"days": 30}`)
+	cartons := []Carton{}
+	json.Unmarshal(res.Payload, &cartons)
+	if len(cartons) != 1 || cartons[0].Id != created.Carton.Id {
+		t.Error("Unexpected expiring cartons: " + string(res.Payload))
+	}
+
+	// a single package of another carton expiring soon
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	later := testCarton("Aspirin", 2)
+	later.ExpiryDate = mock.DefaultTxTime.AddDate(0, 0, 20)
+	split := createCarton(t, stub, "tx4-create", later)
+	splitRef, _ := json.Marshal(CartonRef{CartonId: split.Carton.Id, PackageIds: []string{split.PackageList[0].Id}, Buyer: testdata.TestUser1CN})
+	res = invoke(stub, "tx4-split", "transferPackages", string(splitRef))
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+	if res := invoke(stub, "tx4-accept", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	res = invoke(stub, "tx4-list", "listExpiringCartons", `{"days": 30}`)
+	json.Unmarshal(res.Payload, &cartons)
+	if len(cartons) != 2 || cartons[0].Id != created.Carton.Id || cartons[1].Id != split.Carton.Id {
+		t.Error("Unexpected expiring cartons with single packages: " + string(res.Payload))
+	}
+
+	if res := invoke(stub, "tx4-days", "listExpiringCartons", `{"days": 9000000000000000000}`); res.Status == shim.OK {
+		t.Error("An out of range number of days was accepted")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.AddDate(0, 0, 11))
+	ref, _ := json.Marshal(PackageRef{CartonId: created.Carton.Id, PackageId: created.PackageList[0].Id})
+	if res := invoke(stub, "tx5", "sellPackage", string(ref)); res.Status == shim.OK {
+		t.Error("Expired package could be sold")
+	}
+}
+
+func newContainer(t *testing.T, stub *mock.FullMockStub, txId string, containerType string) Container {
+	res := invoke(stub, txId, "createContainer", `{"type": "`+containerType+`"}`)
+	if res.Status != shim.OK {
+		t.Fatal("createContainer failed: " + res.Message)
+	}
+
+	container := Container{}
+	json.Unmarshal(res.Payload, &container)
+	return container
+}
+
+func aggregate(t *testing.T, stub *mock.FullMockStub, txId string, function string, request AggregationRequest) pb.Response {
+	requestBytes, _ := json.Marshal(request)
+	return invoke(stub, txId, function, string(requestBytes))
+}
+
+func TestAggregation(t *testing.T) {
+	stub := initChain(t)
+	cc := &CounterfeitCC{}
+
+	first := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	second := createCarton(t, stub, "tx2", testCarton("Aspirin", 1))
+	pallet := newContainer(t, stub, "tx3", ContainerPallet)
+	box := newContainer(t, stub, "tx4", ContainerCase)
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	if res := aggregate(t, stub, "tx5", "aggregate", AggregationRequest{ContainerId: box.Id, ContainerIds: []string{pallet.Id}}); res.Status == shim.OK {
+		t.Error("A pallet could be packed into a case")
+	}
+
+	if res := aggregate(t, stub, "tx6", "aggregate", AggregationRequest{ContainerId: box.Id, CartonIds: []string{first.Carton.Id, second.Carton.Id}}); res.Status != shim.OK {
+		t.Fatal("aggregate cartons failed: " + res.Message)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	if res := aggregate(t, stub, "tx7", "aggregate", AggregationRequest{ContainerId: pallet.Id, ContainerIds: []string{box.Id}}); res.Status != shim.OK {
+		t.Fatal("aggregate case failed: " + res.Message)
+	}
+
+	single, _ := json.Marshal(CartonRef{CartonId: first.Carton.Id, Buyer: testdata.TestUser3CN})
+	if res := invoke(stub, "tx8", "sellCarton", string(single)); res.Status == shim.OK {
+		t.Error("A packed carton could be offered on its own")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(3 * time.Hour))
+	offerRef, _ := json.Marshal(CartonRef{ContainerId: pallet.Id, Buyer: testdata.TestUser3CN})
+	res := invoke(stub, "tx9", "offerTransfer", string(offerRef))
+	if res.Status != shim.OK {
+		t.Fatal("Pallet offer failed: " + res.Message)
+	}
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	if res := aggregate(t, stub, "tx10", "disaggregate", AggregationRequest{ContainerId: box.Id}); res.Status == shim.OK {
+		t.Error("A case on an offered pallet could be unpacked")
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+	if res := invoke(stub, "tx11", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("Pallet transfer failed: " + res.Message)
+	}
+
+	for _, created := range []CreateCartonResponse{first, second} {
+		carton, _ := cc.getCarton(stub, created.Carton.Id)
+		if carton.Owner != testdata.TestUser3CN {
+			t.Error("Carton on the pallet didn't change hands")
+		}
+	}
+
+	stored, _ := cc.getContainer(stub, box.Id)
+	if stored.Owner != testdata.TestUser3CN {
+		t.Error("Case on the pallet didn't change hands")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(4 * time.Hour))
+	if res := aggregate(t, stub, "tx12", "disaggregate", AggregationRequest{ContainerId: box.Id}); res.Status != shim.OK {
+		t.Fatal("disaggregate failed: " + res.Message)
+	}
+
+	ref, _ := json.Marshal(PackageRef{CartonId: first.Carton.Id, PackageId: first.PackageList[0].Id})
+	res = invoke(stub, "tx13", "getPackageHistory", string(ref))
+	response := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &response)
+
+	if len(response.Containment) != 2 {
+		t.Fatal("Unexpected containment chain: " + string(res.Payload))
+	}
+
+	inCase, onPallet := response.Containment[0], response.Containment[1]
+	if inCase.ContainerId != box.Id || inCase.Type != ContainerCase || inCase.Content != first.Carton.Id ||
+		!inCase.Unpacked.Equal(mock.DefaultTxTime.Add(4*time.Hour)) {
+		t.Error("Unexpected case entry in the containment chain")
+	}
+
+	if onPallet.ContainerId != pallet.Id || onPallet.Content != box.Id || !onPallet.Unpacked.IsZero() {
+		t.Error("Unexpected pallet entry in the containment chain")
+	}
+}
+
+func TestTransferPackages(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 3))
+	cartonId := created.Carton.Id
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Minute))
+	transferCarton(t, stub, "tx2", cartonId, testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+
+	split := created.PackageList[0].Id
+	kept := created.PackageList[1].Id
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Minute))
+	ref, _ := json.Marshal(CartonRef{CartonId: cartonId, PackageIds: []string{split}, Buyer: testdata.TestUser1CN})
+	res := invoke(stub, "tx3", "transferPackages", string(ref))
+	if res.Status != shim.OK {
+		t.Fatal("transferPackages failed: " + res.Message)
+	}
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	if res := invoke(stub, "tx4", "transferPackages", string(ref)); res.Status == shim.OK {
+		t.Error("Locked package could be offered twice")
+	}
+
+	cartonRef, _ := json.Marshal(CartonRef{CartonId: cartonId, Buyer: testdata.TestUser1CN})
+	if res := invoke(stub, "tx4", "offerTransfer", string(cartonRef)); res.Status == shim.OK {
+		t.Error("Carton could be offered while some of its packages are")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+	if res := invoke(stub, "tx5", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	cc := &CounterfeitCC{}
+	carton, _ := cc.getCarton(stub, cartonId)
+	if carton.Owner != testdata.TestUser3CN {
+		t.Error("Carton changed hands with a partial transfer")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(3 * time.Minute))
+	keptRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: kept})
+	if res := invoke(stub, "tx6", "sellPackage", string(keptRef)); res.Status == shim.OK {
+		t.Error("Package of somebody else's carton could be sold")
+	}
+
+	splitRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: split})
+	if res := invoke(stub, "tx7", "sellPackage", string(splitRef)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	// the reseller no longer holds the package
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res := invoke(stub, "tx8", "transferPackages", string(ref)); res.Status == shim.OK {
+		t.Error("Sold package of another owner could be offered")
+	}
+
+	res = invoke(stub, "tx9", "getPackageHistory", string(splitRef))
+	response := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &response)
+
+	expected := []HistoryEntry{
+		{Object: ObjectCarton, Change: ChangeCreated, Owner: testdata.TestUser2CN, TxId: "tx1"},
+		{Object: ObjectPackage, Change: ChangeCreated, Owner: testdata.TestUser2CN, TxId: "tx1"},
+		{Object: ObjectCarton, Change: ChangeTransferred, Owner: testdata.TestUser3CN, TxId: "tx2"},
+		{Object: ObjectPackage, Change: ChangeUpdated, Owner: testdata.TestUser3CN, TxId: "tx2"},
+		{Object: ObjectPackage, Change: ChangeTransferred, Owner: testdata.TestUser1CN, TxId: "tx5"},
+		{Object: ObjectPackage, Change: ChangeSold, Owner: testdata.TestUser1CN, TxId: "tx7"},
+	}
+
+	if len(response.OwnerHistory) != len(expected) {
+		t.Fatal("Unexpected history: " + string(res.Payload))
+	}
+
+	for i, entry := range response.OwnerHistory {
+		if entry.Object != expected[i].Object || entry.Change != expected[i].Change ||
+			entry.Owner != expected[i].Owner || entry.TxId != expected[i].TxId {
+			t.Error("Unexpected history entry: " + entry.TxId + " " + entry.Object + " " + entry.Change + " " + entry.Owner)
+		}
+	}
+}
+
+func TestSplitPackageHistory(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 2))
+	cartonId := created.Carton.Id
+	split := created.PackageList[0].Id
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Minute))
+	ref, _ := json.Marshal(CartonRef{CartonId: cartonId, PackageIds: []string{split}, Buyer: testdata.TestUser3CN})
+	res := invoke(stub, "tx2", "transferPackages", string(ref))
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+	if res = invoke(stub, "tx3", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	// the rest of the carton goes elsewhere
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Minute))
+	transferCarton(t, stub, "tx4", cartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	splitRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: split})
+	res = invoke(stub, "tx5", "getPackageHistory", string(splitRef))
+	response := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &response)
+
+	for _, entry := range response.OwnerHistory {
+		if entry.TxId == "tx4" || entry.Owner == testdata.TestUser1CN {
+			t.Errorf("Carton entry applied to a split package: %v", entry)
+		}
+	}
+
+	if last := response.OwnerHistory[len(response.OwnerHistory)-1]; last.Owner != testdata.TestUser3CN || last.TxId != "tx3" {
+		t.Errorf("Unexpected last history entry %v", last)
+	}
+
+	res = invoke(stub, "tx6", "getRoute", string(splitRef))
+	route := RouteResponse{}
+	json.Unmarshal(res.Payload, &route)
+	if len(route.Stops) != 3 || route.Stops[2].Event != StopReceived || route.Stops[2].Party != testdata.TestUser3CN {
+		t.Error("Unexpected route of a split package: " + string(res.Payload))
+	}
+}
+
+func TestReturns(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 3))
+	cartonId := created.Carton.Id
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Minute))
+	transferCarton(t, stub, "tx2", cartonId, testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Minute))
+	transferCarton(t, stub, "tx3", cartonId, testdata.TestUser3Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	sold, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: created.PackageList[0].Id})
+	if res := invoke(stub, "tx4", "sellPackage", string(sold)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	requestReturn := func(txId string, request ReturnRequest) (ReturnRequest, pb.Response) {
+		arg, _ := json.Marshal(request)
+		res := invoke(stub, txId, "requestReturn", string(arg))
+		result := ReturnRequest{}
+		json.Unmarshal(res.Payload, &result)
+		return result, res
+	}
+	returnArg := func(request ReturnRequest, disposition string) string {
+		arg, _ := json.Marshal(ReturnRef{ReturnId: request.Id, Disposition: disposition})
+		return string(arg)
+	}
+
+	if _, res := requestReturn("tx5", ReturnRequest{CartonId: cartonId, Receiver: testdata.TestUser3CN, Reason: ReturnExcess}); res.Status == shim.OK {
+		t.Error("Carton with a sold package could be returned as a whole")
+	}
+
+	damagedId := created.PackageList[1].Id
+	damaged := ReturnRequest{CartonId: cartonId, PackageIds: []string{damagedId}, Receiver: testdata.TestUser3CN, Reason: "broken"}
+	if _, res := requestReturn("tx6", damaged); res.Status == shim.OK {
+		t.Error("Return with an unknown reason was accepted")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(3 * time.Minute))
+	damaged.Reason = ReturnDamaged
+	request, res := requestReturn("tx7", damaged)
+	if res.Status != shim.OK || request.Status != ReturnRequested {
+		t.Fatal("requestReturn failed: " + res.Message)
+	}
+
+	damagedRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: damagedId})
+	if res := invoke(stub, "tx8", "sellPackage", string(damagedRef)); res.Status == shim.OK {
+		t.Error("Returned package could be sold")
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res := invoke(stub, "tx9", "acceptReturn", returnArg(request, "")); res.Status == shim.OK {
+		t.Error("Return was accepted by somebody else than the receiver")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(4 * time.Minute))
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res := invoke(stub, "tx10", "acceptReturn", returnArg(request, "")); res.Status != shim.OK {
+		t.Fatal("acceptReturn failed: " + res.Message)
+	}
+
+	if res := invoke(stub, "tx11", "completeReturn", returnArg(request, "resold")); res.Status == shim.OK {
+		t.Error("Return was closed with an unknown disposition")
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(5 * time.Minute))
+	if res := invoke(stub, "tx12", "completeReturn", returnArg(request, ReturnDestroyed)); res.Status != shim.OK {
+		t.Fatal("completeReturn failed: " + res.Message)
+	}
+
+	// excess stock sent back to the producer, who turns it down
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	excessId := created.PackageList[2].Id
+	excess, res := requestReturn("tx13", ReturnRequest{CartonId: cartonId, PackageIds: []string{excessId}, Receiver: testdata.TestUser2CN, Reason: ReturnExcess})
+	if res.Status != shim.OK {
+		t.Fatal("requestReturn failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res := invoke(stub, "tx14", "rejectReturn", returnArg(excess, "")); res.Status != shim.OK {
+		t.Fatal("rejectReturn failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	excessRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: excessId})
+	if res := invoke(stub, "tx15", "sellPackage", string(excessRef)); res.Status != shim.OK {
+		t.Error("Package of a rejected return can't be sold: " + res.Message)
+	}
+
+	res = invoke(stub, "tx16", "getPackageHistory", string(damagedRef))
+	response := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &response)
+
+	expected := []struct {
+		change string
+		owner  string
+		txId   string
+	}{
+		{ChangeReturned, testdata.TestUser1CN, "tx7"},
+		{ChangeReturned, testdata.TestUser3CN, "tx10"},
+		{ChangeDestroyed, testdata.TestUser3CN, "tx12"},
+	}
+
+	history := response.OwnerHistory
+	if len(history) < len(expected) || len(response.Returns) != 1 || response.Returns[0].Status != ReturnDestroyed {
+		t.Fatal("Unexpected history: " + string(res.Payload))
+	}
+
+	history = history[len(history)-len(expected):]
+	for i, entry := range history {
+		if entry.Object != ObjectPackage || entry.Change != expected[i].change ||
+			entry.Owner != expected[i].owner || entry.TxId != expected[i].txId {
+			t.Error("Unexpected history entry: " + entry.TxId + " " + entry.Object + " " + entry.Change + " " + entry.Owner)
+		}
+	}
+
+	cartonRef, _ := json.Marshal(PackageRef{CartonId: cartonId})
+	res = invoke(stub, "tx17", "getCartonHistory", string(cartonRef))
+	cartonHistory := CartonHistoryResponse{}
+	json.Unmarshal(res.Payload, &cartonHistory)
+	if res.Status != shim.OK || len(cartonHistory.Returns) != 2 || cartonHistory.Returns[1].Status != ReturnRejected {
+		t.Error("Unexpected carton history: " + string(res.Payload))
+	}
+
+	// a package on offer keeps its carton from going back as a whole
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	offered := createCarton(t, stub, "tx18", testCarton("Aspirin", 2))
+	transferCarton(t, stub, "tx19", offered.Carton.Id, testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+	offerRef, _ := json.Marshal(CartonRef{CartonId: offered.Carton.Id, PackageIds: []string{offered.PackageList[0].Id}, Buyer: testdata.TestUser1CN})
+	if res := invoke(stub, "tx20", "offerTransfer", string(offerRef)); res.Status != shim.OK {
+		t.Fatal("offerTransfer failed: " + res.Message)
+	}
+
+	if _, res := requestReturn("tx21", ReturnRequest{CartonId: offered.Carton.Id, Receiver: testdata.TestUser2CN, Reason: ReturnExcess}); res.Status == shim.OK {
+		t.Error("Carton with a package on offer could be returned as a whole")
+	}
+}
+
+func TestReturnSplitPackages(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 2))
+	cartonId := created.Carton.Id
+	split := created.PackageList[0].Id
+
+	// the reseller only ever holds a single package and hands it on
+	offerPackages := func(txId string, seller string, buyer string, buyerCert string) {
+		stub.MockCreator("default", seller)
+		ref, _ := json.Marshal(CartonRef{CartonId: cartonId, PackageIds: []string{split}, Buyer: buyer})
+		res := invoke(stub, txId, "transferPackages", string(ref))
+		offer := TransferOffer{}
+		json.Unmarshal(res.Payload, &offer)
+
+		stub.MockCreator("default", buyerCert)
+		transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+		if res = invoke(stub, txId + "-accept", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+			t.Fatal("acceptTransfer failed: " + res.Message)
+		}
+	}
+	offerPackages("tx2", testdata.TestUser2Cert, testdata.TestUser3CN, testdata.TestUser3Cert)
+	offerPackages("tx3", testdata.TestUser3Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	request, _ := json.Marshal(ReturnRequest{CartonId: cartonId, PackageIds: []string{split}, Receiver: testdata.TestUser3CN, Reason: ReturnDamaged})
+	if res := invoke(stub, "tx4", "requestReturn", string(request)); res.Status != shim.OK {
+		t.Fatal("Split package couldn't go back to its supplier: " + res.Message)
+	}
+}
+
+func TestListMyCartons(t *testing.T) {
+	stub := initChain(t)
+
+	var ids []string
+	for i, name := range []string{"Aspirin", "Ibuprofen", "Aspirin", "Aspirin"} {
+		created := createCarton(t, stub, "tx" + uintToString(uint64(i)), testCarton(name, 1))
+		ids = append(ids, created.Carton.Id)
+	}
+	transferCarton(t, stub, "tx-transfer", ids[3], testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	list := func(caller string, query InventoryQuery) CartonPage {
+		stub.MockCreator("default", caller)
+		arg, _ := json.Marshal(query)
+		res := invoke(stub, "tx-list", "listMyCartons", string(arg))
+		if res.Status != shim.OK {
+			t.Fatal("listMyCartons failed: " + res.Message)
+		}
+
+		page := CartonPage{}
+		json.Unmarshal(res.Payload, &page)
+		return page
+	}
+
+	query := InventoryQuery{PageSize: 2}
+	var listed []string
+	for pages := 0; pages < 3; pages++ {
+		page := list(testdata.TestUser2Cert, query)
+		for _, carton := range page.Cartons {
+			listed = append(listed, carton.Id)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		query.Bookmark = page.Bookmark
+	}
+
+	if len(listed) != 3 || contains(listed, ids[3]) {
+		t.Errorf("Unexpected producer inventory %v", listed)
+	}
+
+	aspirin := list(testdata.TestUser2Cert, InventoryQuery{Name: "Aspirin"})
+	if len(aspirin.Cartons) != 2 || aspirin.Bookmark != "" {
+		t.Errorf("Unexpected cartons filtered by name %v", aspirin.Cartons)
+	}
+
+	mine := list(testdata.TestUser1Cert, InventoryQuery{HasUnsold: true})
+	if len(mine.Cartons) != 1 || mine.Cartons[0].Id != ids[3] {
+		t.Errorf("Unexpected pharmacy inventory %v", mine.Cartons)
+	}
+
+	pckgs, _ := (&CounterfeitCC{}).getCartonPackages(stub, ids[3])
+	packageRef, _ := json.Marshal(PackageRef{CartonId: ids[3], PackageId: pckgs[0].Id})
+	if res := invoke(stub, "tx-sell", "sellPackage", string(packageRef)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	if sold := list(testdata.TestUser1Cert, InventoryQuery{HasUnsold: true}); len(sold.Cartons) != 0 {
+		t.Error("Sold out carton is listed as having unsold packages")
+	}
+
+	// single packages show up in the reseller's inventory
+	for i, cartonId := range []string{ids[0], ids[2]} {
+		txId := "tx-split" + uintToString(uint64(i))
+		stub.MockCreator("default", testdata.TestUser2Cert)
+		split, _ := (&CounterfeitCC{}).getCartonPackages(stub, cartonId)
+		ref, _ := json.Marshal(CartonRef{CartonId: cartonId, PackageIds: []string{split[0].Id}, Buyer: testdata.TestUser3CN})
+		res := invoke(stub, txId, "transferPackages", string(ref))
+		offer := TransferOffer{}
+		json.Unmarshal(res.Payload, &offer)
+
+		stub.MockCreator("default", testdata.TestUser3Cert)
+		transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id})
+		if res := invoke(stub, txId + "-accept", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+			t.Fatal("acceptTransfer failed: " + res.Message)
+		}
+	}
+
+	first := list(testdata.TestUser3Cert, InventoryQuery{PageSize: 1})
+	second := list(testdata.TestUser3Cert, InventoryQuery{PageSize: 1, Bookmark: first.Bookmark})
+	if len(first.Cartons) != 1 || len(second.Cartons) != 1 || second.Bookmark != "" ||
+		!contains([]string{ids[0], ids[2]}, first.Cartons[0].Id) || !contains([]string{ids[0], ids[2]}, second.Cartons[0].Id) ||
+		first.Cartons[0].Id == second.Cartons[0].Id {
+		t.Errorf("Unexpected reseller inventory %v %v", first.Cartons, second.Cartons)
+	}
+
+	if unsold := list(testdata.TestUser2Cert, InventoryQuery{HasUnsold: true}); len(unsold.Cartons) != 1 || unsold.Cartons[0].Id != ids[1] {
+		t.Errorf("Producer still lists the packages it handed on %v", unsold.Cartons)
+	}
+}
+
+func TestListPackages(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 5))
+	cartonId := created.Carton.Id
+	transferCarton(t, stub, "tx2", cartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+
+	for i, pckg := range created.PackageList[:2] {
+		ref, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: pckg.Id})
+		if res := invoke(stub, "tx-sell" + uintToString(uint64(i)), "sellPackage", string(ref)); res.Status != shim.OK {
+			t.Fatal("sellPackage failed: " + res.Message)
+		}
+	}
+
+	query := PackageQuery{CartonId: cartonId, PageSize: 2}
+	sold := 0
+	seen := map[string]bool{}
+	for pages := 0; pages < 5; pages++ {
+		arg, _ := json.Marshal(query)
+		res := invoke(stub, "tx-list", "listPackages", string(arg))
+		if res.Status != shim.OK {
+			t.Fatal("listPackages failed: " + res.Message)
+		}
+
+		page := PackagePage{}
+		json.Unmarshal(res.Payload, &page)
+		if page.Counts.Total != 5 || page.Counts.Sold != 2 || page.Counts.Unsold != 3 {
+			t.Errorf("Unexpected package counts %v", page.Counts)
+		}
+
+		for _, pckg := range page.Packages {
+			seen[pckg.Id] = true
+			if pckg.State == PackageDispensed && !pckg.SellDate.IsZero() {
+				sold++
+			}
+		}
+
+		if page.Bookmark == "" {
+			break
+		}
+		query.Bookmark = page.Bookmark
+	}
+
+	if len(seen) != 5 || sold != 2 {
+		t.Errorf("Pages didn't cover the carton: %d packages, %d sold", len(seen), sold)
+	}
+
+	arg, _ := json.Marshal(PackageQuery{CartonId: cartonId})
+	res := invoke(stub, "tx-get", "getCarton", string(arg))
+	details := CartonDetails{}
+	json.Unmarshal(res.Payload, &details)
+	if res.Status != shim.OK || details.Carton.Id != cartonId || details.Counts.ByState[PackageInDistribution] != 3 {
+		t.Error("Unexpected getCarton response: " + string(res.Payload))
+	}
+}
+
+// lastEvents decodes the envelope sent by the last transaction
+func lastEvents(t *testing.T, stub *mock.FullMockStub) EventEnvelope {
+	event := stub.ChaincodeEvent()
+	if event == nil || event.EventName != EventName {
+		t.Fatal("No chaincode event was sent")
+	}
+
+	envelope := EventEnvelope{}
+	err := json.Unmarshal(event.Payload, &envelope)
+	if err != nil {
+		t.Fatal("Could not parse event envelope: " + err.Error())
+	}
+
+	if envelope.Version != EventVersion || envelope.TxId != event.TxId {
+		t.Error("Unexpected event envelope: " + string(event.Payload))
+	}
+
+	return envelope
+}
+
+func TestEvents(t *testing.T) {
+	stub := initChain(t)
+
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	cartonId := created.Carton.Id
+	if events := lastEvents(t, stub).Events; len(events) != 1 || events[0].Type != EventCartonCreated || events[0].CartonId != cartonId {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	offer := transferCarton(t, stub, "tx2", cartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+	if events := lastEvents(t, stub).Events; len(events) != 1 || events[0].Type != EventTransferCompleted ||
+		events[0].TransferId != offer.Id || events[0].Buyer != testdata.TestUser1CN {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	ref := PackageRef{CartonId: cartonId, PackageId: created.PackageList[0].Id}
+	packageRef, _ := json.Marshal(ref)
+	invoke(stub, "tx3", "sellPackage", string(packageRef))
+	if events := lastEvents(t, stub).Events; len(events) != 1 || events[0].Type != EventPackageSold || events[0].Actor != testdata.TestUser1CN {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	verifyPackage(t, stub, "tx4", ref)
+	if stub.ChaincodeEvent() != nil {
+		t.Error("First scan after the sale sent an event")
+	}
+
+	verifyPackage(t, stub, "tx5", ref)
+	if events := lastEvents(t, stub).Events; len(events) != 2 || events[0].Type != EventAlertRaised ||
+		events[0].Rule != RuleScanAfterDispensing || events[1].Type != EventSuspiciousScan {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	// changes of one transaction share the envelope
+	stub.MockTransactionStart("tx6")
+	batch := newEventStub(stub)
+	emitEvent(batch, Event{Type: EventCartonCreated, CartonId: "1"})
+	emitEvent(batch, Event{Type: EventCartonCreated, CartonId: "2"})
+	stub.MockTransactionEnd("tx6")
+
+	if events := lastEvents(t, stub).Events; len(events) != 2 || events[1].CartonId != "2" {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	stub := initChain(t)
+
+	cartons := []Carton{testCarton("Aspirin", 2), testCarton("Ibuprofen", 1), testCarton("Paracetamol", 3)}
+	arg, _ := json.Marshal(cartons)
+	res := invoke(stub, "tx1", "createCartons", string(arg))
+	if res.Status != shim.OK {
+		t.Fatal("createCartons failed: " + res.Message)
+	}
+
+	created := []CreateCartonResponse{}
+	json.Unmarshal(res.Payload, &created)
+	if len(created) != 3 || created[0].Carton.Id == created[1].Carton.Id || len(created[2].PackageList) != 3 {
+		t.Fatal("Unexpected createCartons response: " + string(res.Payload))
+	}
+
+	if events := lastEvents(t, stub).Events; len(events) != 3 {
+		t.Errorf("Expected one envelope with 3 events, got %v", events)
+	}
+
+	// one bad carton fails the batch before anything is written
+	cartons[1].PackageNum = 0
+	arg, _ = json.Marshal(cartons)
+	res = invoke(stub, "tx2", "createCartons", string(arg))
+	if res.Status == shim.OK || res.Message[:6] != "Item 1" {
+		t.Error("Batch with an invalid carton was accepted: " + res.Message)
+	}
+	if len(stub.WriteSet()) != 0 {
+		t.Error("Failed batch wrote to the ledger")
+	}
+
+	tooMany := make([]Carton, DefaultMaxBatchSize + 1)
+	arg, _ = json.Marshal(tooMany)
+	if res := invoke(stub, "tx3", "createCartons", string(arg)); res.Status == shim.OK {
+		t.Error("Batch above the maximum size was accepted")
+	}
+
+	refs := []CartonRef{
+		{CartonId: created[0].Carton.Id, Buyer: testdata.TestUser3CN},
+		{CartonId: created[1].Carton.Id, Buyer: testdata.TestUser1CN},
+		{CartonId: created[0].Carton.Id, Buyer: testdata.TestUser1CN},
+	}
+	arg, _ = json.Marshal(refs)
+	if res := invoke(stub, "tx4", "sellCartons", string(arg)); res.Status == shim.OK {
+		t.Error("Batch offering a carton twice was accepted")
+	}
+
+	arg, _ = json.Marshal(refs[:2])
+	res = invoke(stub, "tx5", "sellCartons", string(arg))
+	if res.Status != shim.OK {
+		t.Fatal("sellCartons failed: " + res.Message)
+	}
+
+	offers := []TransferOffer{}
+	json.Unmarshal(res.Payload, &offers)
+	if len(offers) != 2 || offers[0].Id == offers[1].Id || offers[1].Buyer != testdata.TestUser1CN {
+		t.Error("Unexpected sellCartons response: " + string(res.Payload))
+	}
+}
+
+func TestParseElementString(t *testing.T) {
+	now := mock.DefaultTxTime
+
+	data, err := parseElementString("(01)04012345678901(21)A/1(10)L-7(17)270200", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if data.Gtin != "04012345678901" || data.Serial != "A/1" || data.Lot != "L-7" ||
+		!data.Expiry.Equal(time.Date(2027, time.February, 28, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected GS1 data %v", data)
+	}
+
+	encoded, err := parseElementString("0104012345678901" + "21A/1" + GroupSeparator + "17270200" + "10L-7", now)
+	if err != nil || !reflect.DeepEqual(encoded, data) {
+		t.Errorf("Barcode form parsed differently: %v %v", encoded, err)
+	}
+
+	if expiry, _ := parseExpiry("991231", now); expiry.Year() != 1999 {
+		t.Error("Expiry year outside the GS1 window: " + expiry.String())
+	}
+
+	for _, invalid := range []string{
+		"(01)04012345678902(21)A1",
+		"(21)A1",
+		"(01)04012345678901(21)A 1",
+		"(01)04012345678901(17)271301",
+		"(01)04012345678901(17)270230",
+		"(01)04012345678901(21)A1(21)A2",
+		"(01)04012345678901(99)X",
+		"010401234567890",
+	} {
+		if _, err := parseElementString(invalid, now); err == nil {
+			t.Error("Invalid element string was accepted: " + invalid)
+		}
+	}
+}
+
+func TestSerializedPackages(t *testing.T) {
+	stub := initChain(t)
+
+	carton := testCarton("Aspirin", 2)
+	carton.Serials = []string{"SN-1", "SN-2"}
+	created := createCarton(t, stub, "tx1", carton)
+	if created.PackageList[0].Id != "SN-1" || created.PackageList[1].Id != "SN-2" {
+		t.Fatal("Serials were not used as package ids")
+	}
+
+	for i, serials := range [][]string{{"SN-1"}, {"SN-3", "SN-3"}, {"SN-3"}, {"SN 3"}} {
+		invalid := testCarton("Aspirin", len(serials))
+		invalid.Serials = serials
+		if i == 2 {
+			invalid.PackageNum = 2
+		}
+
+		data, _ := json.Marshal(invalid)
+		if res := invoke(stub, "tx2", "createCarton", string(data)); res.Status == shim.OK {
+			t.Errorf("Carton with serials %v was accepted", serials)
+		}
+	}
+
+	batch := []Carton{testCarton("Aspirin", 1), testCarton("Aspirin", 1)}
+	batch[0].Serials = []string{"SN-4"}
+	batch[1].Serials = []string{"SN-4"}
+	data, _ := json.Marshal(batch)
+	if res := invoke(stub, "tx3", "createCartons", string(data)); res.Status == shim.OK {
+		t.Error("Batch with the same SGTIN twice was accepted")
+	}
+
+	lookup := func(sgtin string) pb.Response {
+		data, _ := json.Marshal(PackageRef{Sgtin: sgtin})
+		return invoke(stub, "tx4", "lookupSgtin", string(data))
+	}
+
+	res := lookup("(01)04012345678901(21)SN-2(10)L-Aspirin(17)181101")
+	ref := PackageRef{}
+	json.Unmarshal(res.Payload, &ref)
+	if res.Status != shim.OK || ref.CartonId != created.Carton.Id || ref.PackageId != "SN-2" {
+		t.Error("SGTIN lookup failed: " + res.Message)
+	}
+
+	if res := lookup("(01)04012345678901(21)SN-2(10)L-Other"); res.Status == shim.OK {
+		t.Error("SGTIN with the wrong lot was resolved")
+	}
+
+	transferCarton(t, stub, "tx5", created.Carton.Id, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+	sell, _ := json.Marshal(PackageRef{Sgtin: "0104012345678901" + "21SN-1"})
+	if res := invoke(stub, "tx6", "sellPackage", string(sell)); res.Status != shim.OK {
+		t.Fatal("sellPackage by SGTIN failed: " + res.Message)
+	}
+
+	pckg, _ := (&CounterfeitCC{}).getPackage(stub, created.Carton.Id, "SN-1")
+	if pckg.State != PackageDispensed {
+		t.Error("Package sold by SGTIN is " + pckg.State)
+	}
+
+	if result := verifyPackage(t, stub, "tx7", PackageRef{Sgtin: "(01)04012345678901(21)SN-9"}); result.Verdict != VerdictUnknown {
+		t.Error("Unregistered SGTIN is not unknown: " + result.Verdict)
+	}
+}
+
+func TestExportEpcis(t *testing.T) {
+	stub := initChain(t)
+
+	plant := Site{Gln: "4012345000016", Name: "Plant", Address: Address{City: "Basel", Country: "CH"}}
+	pharmacy := Site{Gln: "4012345000023", Name: "Pharmacy", Address: Address{City: "Bern", Country: "CH"}}
+	registerSite(t, stub, "tx1", plant)
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	registerSite(t, stub, "tx2", pharmacy)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	carton := testCarton("Aspirin", 2)
+	carton.Serials = []string{"SN-1", "SN-2"}
+	carton.Site = plant.Gln
+	created := createCarton(t, stub, "tx3", carton)
+	cartonId := created.Carton.Id
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	offerRef, _ := json.Marshal(CartonRef{CartonId: cartonId, Buyer: testdata.TestUser1CN, Site: plant.Gln})
+	res := invoke(stub, "tx4", "sellCarton", string(offerRef))
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id, Site: pharmacy.Gln})
+	if res = invoke(stub, "tx5", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	ref, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: "SN-1", Site: pharmacy.Gln})
+	if res := invoke(stub, "tx6", "sellPackage", string(ref)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	res = invoke(stub, "tx7", "exportEpcis", string(ref))
+	if res.Status != shim.OK {
+		t.Fatal("exportEpcis failed: " + res.Message)
+	}
+
+	document := EpcisDocument{}
+	json.Unmarshal(res.Payload, &document)
+	if document.Type != "EPCISDocument" || document.SchemaVersion != "2.0" || document.Context[0] != EpcisContext {
+		t.Error("Unexpected EPCIS document header: " + string(res.Payload))
+	}
+
+	expected := []struct {
+		eventType string
+		bizStep   string
+		gln       string
+	}{
+		{EpcisObjectEvent, BizStepCommissioning, plant.Gln},
+		{EpcisAggregationEvent, BizStepPacking, plant.Gln},
+		{EpcisObjectEvent, BizStepShipping, plant.Gln},
+		{EpcisObjectEvent, BizStepReceiving, pharmacy.Gln},
+		{EpcisObjectEvent, BizStepDispensing, pharmacy.Gln},
+	}
+
+	events := document.Body.EventList
+	if len(events) != len(expected) {
+		t.Fatal("Unexpected EPCIS events: " + string(res.Payload))
+	}
+
+	for i, event := range events {
+		if event.Type != expected[i].eventType || event.BizStep != expected[i].bizStep ||
+			event.BizLocation == nil || event.BizLocation.Id != "https://id.gs1.org/414/" + expected[i].gln {
+			t.Errorf("Unexpected EPCIS event %d: %v", i, event)
+		}
+	}
+
+	if events[0].EpcList[0] != "https://id.gs1.org/01/04012345678901/21/SN-1" || events[0].Ilmd.LotNumber != "L-Aspirin" {
+		t.Errorf("Unexpected commissioning event %v", events[0])
+	}
+
+	if events[2].DestinationList[0].Destination != partyId(testdata.TestUser1CN) {
+		t.Errorf("Unexpected shipping event %v", events[2])
+	}
+
+	// serials may hold characters that are reserved in URIs
+	if epc := packageEpc(Carton{Gtin: carton.Gtin, Serialized: true}, "A/1%?#"); epc != "https://id.gs1.org/01/04012345678901/21/A%2F1%25%3F%23" {
+		t.Errorf("Unexpected EPC %s", epc)
+	}
+}
+
+// sensorCert creates a key and a self-signed certificate for a data logger
+func sensorCert(t *testing.T, sensor string) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: sensor},
+		NotBefore:    mock.DefaultTxTime.AddDate(-1, 0, 0),
+		NotAfter:     mock.DefaultTxTime.AddDate(1, 0, 0),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func signReadings(t *testing.T, key *ecdsa.PrivateKey, batch ReadingBatch) string {
+	data, _ := json.Marshal(batch)
+	digest := sha256.Sum256(data)
+	signature, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := json.Marshal(SignedReadings{
+		Batch:     data,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	return string(signed)
+}
+
+func TestColdChain(t *testing.T) {
+	stub := initChain(t)
+
+	carton := testCarton("Insulin", 2)
+	carton.Storage = &StorageConditions{Temperature: &Range{Min: 2, Max: 8}}
+	created := createCarton(t, stub, "tx1", carton)
+	cartonId := created.Carton.Id
+
+	invalid := testCarton("Insulin", 1)
+	invalid.Storage = &StorageConditions{Humidity: &Range{Min: 10, Max: 120}}
+	data, _ := json.Marshal(invalid)
+	if res := invoke(stub, "tx2", "createCarton", string(data)); res.Status == shim.OK {
+		t.Error("A humidity range above 100 percent must be refused")
+	}
+
+	key, cert := sensorCert(t, "logger-1")
+	reading := func(minutes int, temperature float64) SensorReading {
+		return SensorReading{Time: mock.DefaultTxTime.Add(time.Duration(minutes) * time.Minute), Temperature: &temperature}
+	}
+
+	// only the admin vouches for sensors
+	sensor, _ := json.Marshal(Sensor{Certificate: cert})
+	if res := invoke(stub, "tx2a", "registerSensor", string(sensor)); res.Status == shim.OK {
+		t.Error("A producer must not register sensors")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res := invoke(stub, "tx2b", "registerSensor", string(sensor)); res.Status != shim.OK {
+		t.Fatal("registerSensor failed: " + res.Message)
+	}
+	stub.MockCreator("default", testdata.TestUser2Cert)
+
+	// a self-made certificate of an unregistered logger isn't trusted
+	rogueKey, _ := sensorCert(t, "logger-2")
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	rogue := signReadings(t, rogueKey, ReadingBatch{CartonId: cartonId, Sensor: "logger-2", Readings: []SensorReading{reading(5, 4)}})
+	if res := invoke(stub, "tx2c", "submitReadings", rogue); res.Status == shim.OK {
+		t.Error("Readings of an unregistered sensor must be refused")
+	}
+
+	inRange := signReadings(t, key, ReadingBatch{CartonId: cartonId, Sensor: "logger-1", Readings: []SensorReading{reading(5, 4), reading(10, 5.5)}})
+	res := invoke(stub, "tx3", "submitReadings", inRange)
+	if res.Status != shim.OK {
+		t.Fatal("submitReadings failed: " + res.Message)
+	}
+
+	if res = invoke(stub, "tx4", "submitReadings", inRange); res.Status == shim.OK {
+		t.Error("A reading batch must not be submitted twice")
+	}
+
+	otherKey, _ := sensorCert(t, "logger-1")
+	forged := signReadings(t, otherKey, ReadingBatch{CartonId: cartonId, Sensor: "logger-1", Readings: []SensorReading{reading(15, 4)}})
+	if res = invoke(stub, "tx5", "submitReadings", forged); res.Status == shim.OK {
+		t.Error("A batch signed with another key must be refused")
+	}
+
+	// two excursions, the first one over two readings
+	excursion := signReadings(t, key, ReadingBatch{CartonId: cartonId, Sensor: "logger-1", Readings: []SensorReading{
+		reading(20, 9), reading(25, 11.5), reading(30, 6), reading(35, 1),
+	}})
+	res = invoke(stub, "tx6", "submitReadings", excursion)
+	if res.Status != shim.OK {
+		t.Fatal("submitReadings failed: " + res.Message)
+	}
+
+	if events := lastEvents(t, stub).Events; len(events) != 1 || events[0].Type != EventExcursion || events[0].CartonIds[0] != cartonId {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	ref, _ := json.Marshal(ColdChainRef{CartonId: cartonId})
+	res = invoke(stub, "tx7", "getColdChain", string(ref))
+	status := ColdChainStatus{}
+	json.Unmarshal(res.Payload, &status)
+	if status.Status != ColdChainQuarantined || status.Readings != 6 || len(status.Excursions) != 2 {
+		t.Fatal("Unexpected cold chain status: " + string(res.Payload))
+	}
+
+	first := status.Excursions[0]
+	if first.Measure != MeasureTemperature || first.Peak != 11.5 || !first.End.Equal(reading(25, 0).Time) || status.Excursions[1].Peak != 1 {
+		t.Errorf("Unexpected excursions %v", status.Excursions)
+	}
+
+	offer := transferCarton(t, stub, "tx8", cartonId, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+	if !reflect.DeepEqual(offer.Quarantined, []string{cartonId}) {
+		t.Errorf("The transfer must show the quarantined carton: %v", offer.Quarantined)
+	}
+
+	packageRef := PackageRef{CartonId: cartonId, PackageId: created.PackageList[0].Id}
+	if result := verifyPackage(t, stub, "tx9", packageRef); result.ColdChain != ColdChainQuarantined || result.Excursions != 2 {
+		t.Errorf("The verification must show the excursions: %v", result)
+	}
+
+	packageData, _ := json.Marshal(packageRef)
+	if res = invoke(stub, "tx10", "sellPackage", string(packageData)); res.Status == shim.OK {
+		t.Error("A quarantined package must not be sold")
+	}
+
+	if res = invoke(stub, "tx11", "releaseQuarantine", string(ref)); res.Status == shim.OK {
+		t.Error("Only the producer may release the quarantine")
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	if res = invoke(stub, "tx12", "releaseQuarantine", string(ref)); res.Status != shim.OK {
+		t.Fatal("releaseQuarantine failed: " + res.Message)
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if res = invoke(stub, "tx13", "sellPackage", string(packageData)); res.Status != shim.OK {
+		t.Error("A released package must be sold: " + res.Message)
+	}
+}
+
+func registerSite(t *testing.T, stub *mock.FullMockStub, txId string, site Site) {
+	data, _ := json.Marshal(site)
+	if res := invoke(stub, txId, "registerSite", string(data)); res.Status != shim.OK {
+		t.Fatal("registerSite failed: " + res.Message)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	stub := initChain(t)
+
+	plant := Site{Gln: "4012345000016", Name: "Plant", Address: Address{City: "Basel", Country: "CH"}, Geo: GeoLocation{Latitude: 47.56, Longitude: 7.59}}
+	registerSite(t, stub, "tx1", plant)
+
+	invalid := plant
+	invalid.Gln = "4012345000017"
+	data, _ := json.Marshal(invalid)
+	if res := invoke(stub, "tx2", "registerSite", string(data)); res.Status == shim.OK {
+		t.Error("A GLN with a wrong check digit must be refused")
+	}
+
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	pharmacy := Site{Gln: "4012345000023", Name: "Pharmacy", Address: Address{City: "Bern", Country: "CH"}, Geo: GeoLocation{Latitude: 46.95, Longitude: 7.44}}
+	registerSite(t, stub, "tx3", pharmacy)
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	carton := testCarton("Aspirin", 2)
+	carton.Site = pharmacy.Gln
+	data, _ = json.Marshal(carton)
+	if res := invoke(stub, "tx4", "createCarton", string(data)); res.Status == shim.OK {
+		t.Error("A carton must not be created at somebody else's site")
+	}
+
+	carton.Site = plant.Gln
+	created := createCarton(t, stub, "tx5", carton)
+	cartonId := created.Carton.Id
+	packageId := created.PackageList[0].Id
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	ref, _ := json.Marshal(CartonRef{CartonId: cartonId, Buyer: testdata.TestUser1CN, Site: plant.Gln})
+	res := invoke(stub, "tx6", "sellCarton", string(ref))
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+	if offer.SellerSite != plant.Gln {
+		t.Fatal("Unexpected transfer offer: " + string(res.Payload))
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id, Site: pharmacy.Gln})
+	if res = invoke(stub, "tx7", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(3 * time.Hour))
+	packageRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: packageId, Site: pharmacy.Gln})
+	if res = invoke(stub, "tx8", "sellPackage", string(packageRef)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	res = invoke(stub, "tx9", "getRoute", string(packageRef))
+	if res.Status != shim.OK {
+		t.Fatal("getRoute failed: " + res.Message)
+	}
+
+	route := RouteResponse{}
+	json.Unmarshal(res.Payload, &route)
+
+	expected := []struct {
+		event string
+		party string
+		gln   string
+	}{
+		{StopCreated, testdata.TestUser2CN, plant.Gln},
+		{StopShipped, testdata.TestUser2CN, plant.Gln},
+		{StopReceived, testdata.TestUser1CN, pharmacy.Gln},
+		{StopSold, testdata.TestUser1CN, pharmacy.Gln},
+	}
+
+	if len(route.Stops) != len(expected) {
+		t.Fatal("Unexpected route: " + string(res.Payload))
+	}
+
+	for i, stop := range route.Stops {
+		if stop.Event != expected[i].event || stop.Party != expected[i].party || stop.Site == nil || stop.Site.Gln != expected[i].gln {
+			t.Errorf("Unexpected stop %d: %v", i, stop)
+		}
+	}
+
+	if route.Stops[3].Site.Geo.Latitude != 46.95 {
+		t.Errorf("The route must carry the position of the sites: %v", route.Stops[3].Site)
+	}
+
+	// the other package wasn't sold
+	otherRef, _ := json.Marshal(PackageRef{CartonId: cartonId, PackageId: created.PackageList[1].Id})
+	res = invoke(stub, "tx10", "getRoute", string(otherRef))
+	json.Unmarshal(res.Payload, &route)
+	if len(route.Stops) != 3 {
+		t.Error("Unexpected route: " + string(res.Payload))
+	}
+
+	// a return is a leg of the route too
+	returnRequest, _ := json.Marshal(ReturnRequest{CartonId: cartonId, PackageIds: []string{created.PackageList[1].Id}, Receiver: testdata.TestUser2CN, Reason: ReturnExcess, Site: pharmacy.Gln})
+	res = invoke(stub, "tx11", "requestReturn", string(returnRequest))
+	request := ReturnRequest{}
+	json.Unmarshal(res.Payload, &request)
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(4 * time.Hour))
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	returnRef, _ := json.Marshal(ReturnRef{ReturnId: request.Id, Site: plant.Gln})
+	if res = invoke(stub, "tx12", "acceptReturn", string(returnRef)); res.Status != shim.OK {
+		t.Fatal("acceptReturn failed: " + res.Message)
+	}
+
+	res = invoke(stub, "tx13", "getRoute", string(otherRef))
+	route = RouteResponse{}
+	json.Unmarshal(res.Payload, &route)
+	if len(route.Stops) != 5 || route.Stops[3].Gln != pharmacy.Gln || route.Stops[4].Event != StopReceived || route.Stops[4].Gln != plant.Gln {
+		t.Error("Unexpected route after a return: " + string(res.Payload))
+	}
+}
+
+func listAlerts(t *testing.T, stub *mock.FullMockStub, txId string, query AlertQuery) AlertPage {
+	data, _ := json.Marshal(query)
+	res := invoke(stub, txId, "listAlerts", string(data))
+	if res.Status != shim.OK {
+		t.Fatal("listAlerts failed: " + res.Message)
+	}
+
+	page := AlertPage{}
+	json.Unmarshal(res.Payload, &page)
+	return page
+}
+
+func TestAlerts(t *testing.T) {
+	stub := initChain(t)
+
+	registerSite(t, stub, "tx1", Site{Gln: "4012345000016", Name: "Plant", Address: Address{City: "Basel", Country: "CH"}, Geo: GeoLocation{Latitude: 47.56, Longitude: 7.59}})
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	registerSite(t, stub, "tx2", Site{Gln: "4012345000023", Name: "Bern", Address: Address{City: "Bern", Country: "CH"}, Geo: GeoLocation{Latitude: 46.95, Longitude: 7.44}})
+	registerSite(t, stub, "tx3", Site{Gln: "4012345000030", Name: "Berlin", Address: Address{City: "Berlin", Country: "DE"}, Geo: GeoLocation{Latitude: 52.52, Longitude: 13.40}})
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	carton := testCarton("Aspirin", 2)
+	carton.Site = "4012345000016"
+	carton.Territories = []string{"CH"}
+	created := createCarton(t, stub, "tx4", carton)
+	cartonId := created.Carton.Id
+	ref := PackageRef{CartonId: cartonId, PackageId: created.PackageList[0].Id}
+
+	// the producer may check its own goods, a reseller that doesn't hold them may not
+	if result := verifyPackage(t, stub, "tx5", ref); result.Verdict != VerdictGenuineUnsold || len(result.Alerts) != 0 {
+		t.Errorf("Unexpected verification by the producer: %v", result)
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if result := verifyPackage(t, stub, "tx6", ref); result.Verdict != VerdictSuspicious || !reflect.DeepEqual(result.Alerts, []string{RuleNonOwnerScan}) {
+		t.Errorf("Unexpected verification by a non-owner: %v", result)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	offerRef, _ := json.Marshal(CartonRef{CartonId: cartonId, Buyer: testdata.TestUser1CN, Site: "4012345000016"})
+	res := invoke(stub, "tx7", "sellCarton", string(offerRef))
+	offer := TransferOffer{}
+	json.Unmarshal(res.Payload, &offer)
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	transferRef, _ := json.Marshal(TransferRef{TransferId: offer.Id, Site: "4012345000023"})
+	if res = invoke(stub, "tx8", "acceptTransfer", string(transferRef)); res.Status != shim.OK {
+		t.Fatal("acceptTransfer failed: " + res.Message)
+	}
+
+	// received in Bern, sold in Berlin half an hour later
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(150 * time.Minute))
+	ref.Site = "4012345000030"
+	packageRef, _ := json.Marshal(ref)
+	if res = invoke(stub, "tx9", "sellPackage", string(packageRef)); res.Status != shim.OK {
+		t.Fatal("sellPackage failed: " + res.Message)
+	}
+
+	if events := lastEvents(t, stub).Events; len(events) != 3 || events[0].Rule != RuleImpossibleTravel || events[1].Rule != RuleOutOfTerritory {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	// the package is checked on the other side of the world
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(4 * time.Hour))
+	scanRef := PackageRef{CartonId: cartonId, PackageId: ref.PackageId, Geo: &GeoLocation{Latitude: -33.87, Longitude: 151.21}}
+	if result := verifyPackage(t, stub, "tx10", scanRef); result.Verdict != VerdictSuspicious || !reflect.DeepEqual(result.Alerts, []string{RuleImpossibleTravel}) {
+		t.Errorf("Unexpected verification far away: %v", result)
+	}
+
+	stub.MockCreator("default", testdata.TestUser2Cert)
+	page := listAlerts(t, stub, "tx11", AlertQuery{})
+	if len(page.Alerts) != 4 {
+		t.Fatalf("Unexpected alerts %v", page.Alerts)
+	}
+
+	page = listAlerts(t, stub, "tx12", AlertQuery{Rule: RuleImpossibleTravel, PageSize: 1})
+	if len(page.Alerts) != 1 || page.Bookmark == "" || page.Alerts[0].Rule != RuleImpossibleTravel {
+		t.Fatalf("Unexpected alert page %v", page)
+	}
+
+	page = listAlerts(t, stub, "tx13", AlertQuery{Rule: RuleImpossibleTravel, PageSize: 1, Bookmark: page.Bookmark})
+	if len(page.Alerts) != 1 || page.Bookmark != "" {
+		t.Fatalf("Unexpected alert page %v", page)
+	}
+
+	triage, _ := json.Marshal(AlertTriage{AlertId: page.Alerts[0].Id, Status: AlertDismissed, Note: "Known traveller"})
+	if res = invoke(stub, "tx14", "triageAlert", string(triage)); res.Status != shim.OK {
+		t.Fatal("triageAlert failed: " + res.Message)
+	}
+
+	if res = invoke(stub, "tx15", "triageAlert", string(triage)); res.Status == shim.OK {
+		t.Error("An alert must only be triaged once")
+	}
+
+	if page = listAlerts(t, stub, "tx16", AlertQuery{Status: AlertOpen}); len(page.Alerts) != 3 {
+		t.Errorf("Unexpected open alerts %v", page.Alerts)
+	}
+
+	// the admin sees all alerts, other participants none
+	stub.MockCreator("default", testdata.TestUser1Cert)
+	if page = listAlerts(t, stub, "tx17", AlertQuery{}); len(page.Alerts) != 4 {
+		t.Errorf("Unexpected alerts for the admin %v", page.Alerts)
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res = invoke(stub, "tx18", "listAlerts"); res.Status == shim.OK {
+		t.Error("A reseller must not list alerts")
+	}
+}
+
+func publicKeyPEM(key *ecdsa.PrivateKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func signPackage(t *testing.T, key *ecdsa.PrivateKey, carton Carton, packageId string) string {
+	digest := sha256.Sum256(packageSignatureData(carton.Id, packageId, carton.Gtin, carton.Lot))
+	signature, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestPackageSignatures(t *testing.T) {
+	stub := initChain(t)
+
+	// creating cartons doesn't register keys, the producer does so once
+	createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+	producerRef, _ := json.Marshal(ProducerRef{Producer: testdata.TestUser2CN})
+	res := invoke(stub, "tx1-keys", "getProducerKeys", string(producerRef))
+	keys := []ProducerKey{}
+	json.Unmarshal(res.Payload, &keys)
+	if len(keys) != 0 {
+		t.Errorf("Keys registered without asking %v", keys)
+	}
+
+	// the key defaults to the one of the enrollment certificate
+	if res = invoke(stub, "tx1-register", "registerKey"); res.Status != shim.OK {
+		t.Fatal("registerKey failed: " + res.Message)
+	}
+	enrollmentKey := ProducerKey{}
+	json.Unmarshal(res.Payload, &enrollmentKey)
+
+	cert, _ := parsePEM(testdata.TestUser2Cert)
+	if id, _ := keyId(cert.PublicKey.(*ecdsa.PublicKey)); enrollmentKey.Id != id || enrollmentKey.Status != KeyActive {
+		t.Fatalf("Unexpected enrollment key %v", enrollmentKey)
+	}
+
+	if res = invoke(stub, "tx2", "registerKey"); res.Status == shim.OK {
+		t.Error("A key must only be registered once")
+	}
+
+	signer, _ := sensorCert(t, "signer")
+	keyRequest, _ := json.Marshal(KeyRequest{PublicKey: publicKeyPEM(signer)})
+	if res = invoke(stub, "tx3", "registerKey", string(keyRequest)); res.Status != shim.OK {
+		t.Fatal("registerKey failed: " + res.Message)
+	}
+	signerKey := ProducerKey{}
+	json.Unmarshal(res.Payload, &signerKey)
+
+	res = invoke(stub, "tx4", "getProducerKeys", string(producerRef))
+	json.Unmarshal(res.Payload, &keys)
+	for _, key := range keys {
+		if key.Id == enrollmentKey.Id && key.Status != KeyRetired || key.Id == signerKey.Id && key.Status != KeyActive {
+			t.Errorf("Unexpected keys after rotation %v", keys)
+		}
+	}
+
+	created := createCarton(t, stub, "tx5", testCarton("Aspirin", 2))
+	carton := created.Carton
+	first := created.PackageList[0].Id
+	second := created.PackageList[1].Id
+
+	// a signature over another package is refused
+	forged, _ := json.Marshal(PackageSignatures{CartonId: carton.Id, Signatures: map[string]string{first: signPackage(t, signer, carton, second)}})
+	if res = invoke(stub, "tx6", "signPackages", string(forged)); res.Status == shim.OK {
+		t.Error("A signature of another package must be refused")
+	}
+
+	signature := signPackage(t, signer, carton, first)
+	signatures, _ := json.Marshal(PackageSignatures{CartonId: carton.Id, Signatures: map[string]string{first: signature, second: signPackage(t, signer, carton, second)}})
+	if res = invoke(stub, "tx7", "signPackages", string(signatures)); res.Status != shim.OK {
+		t.Fatal("signPackages failed: " + res.Message)
+	}
+
+	pckg, _ := (&CounterfeitCC{}).getPackage(stub, carton.Id, first)
+	if pckg.Signature != signature || pckg.KeyId != signerKey.Id {
+		t.Errorf("Unexpected signed package %v", pckg)
+	}
+
+	ref := PackageRef{CartonId: carton.Id, PackageId: first, Signature: signature}
+	if result := verifyPackage(t, stub, "tx8", ref); result.Signature != SignatureValid || result.Verdict != VerdictGenuineUnsold {
+		t.Errorf("Unexpected verification of a signed tag: %v", result)
+	}
+
+	// a copied tag carries the signature of another package
+	copied := PackageRef{CartonId: carton.Id, PackageId: second, Signature: signature}
+	if result := verifyPackage(t, stub, "tx9", copied); result.Signature != SignatureInvalid || result.Verdict != VerdictSuspicious || !reflect.DeepEqual(result.Alerts, []string{RuleInvalidSignature}) {
+		t.Errorf("Unexpected verification of a copied tag: %v", result)
+	}
+
+	// rotated out keys still verify the packages made before, revoked ones don't
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(time.Hour))
+	rotated, _ := sensorCert(t, "rotated")
+	keyRequest, _ = json.Marshal(KeyRequest{PublicKey: publicKeyPEM(rotated)})
+	if res = invoke(stub, "tx10", "registerKey", string(keyRequest)); res.Status != shim.OK {
+		t.Fatal("registerKey failed: " + res.Message)
+	}
+
+	if result := verifyPackage(t, stub, "tx11", ref); result.Signature != SignatureValid {
+		t.Errorf("Unexpected verification with a retired key: %v", result)
+	}
+
+	stub.MockTxTimestamp(mock.DefaultTxTime.Add(2 * time.Hour))
+	later := createCarton(t, stub, "tx11a", testCarton("Aspirin", 1))
+	laterRef := PackageRef{CartonId: later.Carton.Id, PackageId: later.PackageList[0].Id}
+	laterRef.Signature = signPackage(t, signer, later.Carton, laterRef.PackageId)
+	if result := verifyPackage(t, stub, "tx11b", laterRef); result.Signature != SignatureInvalid {
+		t.Errorf("A retired key must not sign packages made after it was retired: %v", result)
+	}
+
+	revokeRequest, _ := json.Marshal(KeyRequest{KeyId: signerKey.Id})
+	if res = invoke(stub, "tx12", "revokeKey", string(revokeRequest)); res.Status != shim.OK {
+		t.Fatal("revokeKey failed: " + res.Message)
+	}
+
+	if result := verifyPackage(t, stub, "tx13", ref); result.Signature != SignatureInvalid || result.Verdict != VerdictSuspicious {
+		t.Errorf("Unexpected verification with a revoked key: %v", result)
+	}
+
+	stub.MockCreator("default", testdata.TestUser3Cert)
+	if res = invoke(stub, "tx14", "registerKey"); res.Status == shim.OK {
+		t.Error("Only producers may register keys")
+	}
+}
+
+func TestTagCodes(t *testing.T) {
+	stub := initChain(t)
+
+	signer, _ := sensorCert(t, "signer")
+	keyRequest, _ := json.Marshal(KeyRequest{PublicKey: publicKeyPEM(signer)})
+	if res := invoke(stub, "tx1", "registerKey", string(keyRequest)); res.Status != shim.OK {
+		t.Fatal("registerKey failed: " + res.Message)
+	}
+
+	carton := testCarton("Aspirin", 2)
+	carton.Serials = []string{"SN-1", "SN-2"}
+	created := createCarton(t, stub, "tx2", carton)
+	carton = created.Carton
+
+	signature := signPackage(t, signer, carton, "SN-1")
+	signatures, _ := json.Marshal(PackageSignatures{CartonId: carton.Id, Signatures: map[string]string{"SN-1": signature}})
+	if res := invoke(stub, "tx3", "signPackages", string(signatures)); res.Status != shim.OK {
+		t.Fatal("signPackages failed: " + res.Message)
+	}
+
+	rawSignature, _ := base64.StdEncoding.DecodeString(signature)
+	tag := tagcode.Tag{
+		CartonId:  carton.Id,
+		PackageId: "SN-1",
+		Gtin:      carton.Gtin,
+		Serial:    "SN-1",
+		Lot:       carton.Lot,
+		Expiry:    carton.ExpiryDate.Format("060102"),
+		Signature: rawSignature,
+	}
+	code, err := tagcode.Encode(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code alone is accepted as argument
+	res := invoke(stub, "tx4", "verifyPackage", code)
+	result := VerificationResult{}
+	json.Unmarshal(res.Payload, &result)
+	if res.Status != shim.OK || result.Verdict != VerdictGenuineUnsold || result.PackageId != "SN-1" || result.Signature != SignatureValid {
+		t.Errorf("Unexpected verification by code: %v %s", result, res.Message)
+	}
+
+	misread := []byte(code)
+	misread[10] ^= 'A' ^ 'B'
+	if res = invoke(stub, "tx5", "verifyPackage", string(misread)); res.Status == shim.OK {
+		t.Error("A misread code must be refused")
+	}
+
+	unknown := tag
+	unknown.CartonId = "999"
+	unknownCode, _ := tagcode.Encode(unknown)
+	if result = verifyPackage(t, stub, "tx6", PackageRef{Code: unknownCode}); result.Verdict != VerdictUnknown {
+		t.Errorf("Code of an unknown carton is %v", result)
+	}
+
+	otherLot := tag
+	otherLot.Lot = "L-Other"
+	otherLotCode, _ := tagcode.Encode(otherLot)
+	if result = verifyPackage(t, stub, "tx7", PackageRef{Code: otherLotCode}); result.Verdict != VerdictUnknown {
+		t.Errorf("Code with the wrong lot is %v", result)
+	}
+
+	transferCarton(t, stub, "tx8", carton.Id, testdata.TestUser2Cert, testdata.TestUser1CN, testdata.TestUser1Cert)
+	if res = invoke(stub, "tx9", "sellPackage", code); res.Status != shim.OK {
+		t.Fatal("sellPackage by code failed: " + res.Message)
+	}
+
+	historyRef, _ := json.Marshal(PackageRef{Code: code})
+	res = invoke(stub, "tx10", "getPackageHistory", string(historyRef))
+	history := PackageHistoryResponse{}
+	json.Unmarshal(res.Payload, &history)
+	if res.Status != shim.OK || len(history.OwnerHistory) == 0 {
+		t.Errorf("getPackageHistory by code failed: %s", res.Message)
+	}
+
+	if pckg, _ := (&CounterfeitCC{}).getPackage(stub, carton.Id, "SN-1"); pckg.State != PackageDispensed {
+		t.Error("Package sold by code is " + pckg.State)
+	}
+}
+
+func initArgs(settings string) [][]byte {
+	if settings == "" {
+		return util.ToChaincodeArgs("init")
+	}
+	return util.ToChaincodeArgs("init", settings)
+}
+
+func TestUpgradeInit(t *testing.T) {
+	fresh := mock.NewFullMockStub("counterfeit", &CounterfeitCC{})
+	fresh.MockCreator("default", testdata.TestUser1Cert)
+	for _, arg := range []string{"", `{"admin": ""}`, `{"admin": "testUser", "maxBatchSize": -1}`} {
+		if res := fresh.MockInit("1", initArgs(arg)); res.Status == shim.OK {
+			t.Errorf("Init with settings '%s' was accepted", arg)
+		}
+	}
+
+	stub := initChain(t)
+	created := createCarton(t, stub, "tx1", testCarton("Aspirin", 1))
+
+	stored := Settings{}
+	json.Unmarshal(stub.State[KeySettings], &stored)
+	if stored.Version != ChaincodeVersion || !reflect.DeepEqual(stored.Migrations, []string{"owner-index"}) {
+		t.Errorf("Unexpected settings of a new ledger %v", stored)
+	}
+
+	// a ledger from before the owner index, whose cartons have no owner
+	stub.MockTransactionStart("tx2")
+	ownerKey, _ := stub.CreateCompositeKey(IndexOwner, []string{testdata.TestUser2CN, created.Carton.Id})
+	stub.DelState(ownerKey)
+	cartonKey, _ := stub.CreateCompositeKey(IndexCartons, []string{created.Carton.Id})
+	stub.PutState(cartonKey, []byte(`{"id":"` + created.Carton.Id + `","name":"Aspirin","productionDate":"2017-06-01T00:00:00Z","description":"","packageNum":1,"producer":"` + testdata.TestUser2CN + `","owner":""}`))
+	legacy, _ := json.Marshal(Settings{Admin: settings.Admin, MaxBatchSize: 10})
+	stub.PutState(KeySettings, legacy)
+	stub.MockTransactionEnd("tx2")
+
+	if res := stub.MockInit("tx3", initArgs("")); res.Status != shim.OK {
+		t.Fatal("Upgrade without settings failed: " + res.Message)
+	}
+
+	json.Unmarshal(stub.State[KeySettings], &stored)
+	if stored.Admin != settings.Admin || stored.MaxBatchSize != 10 || stored.Version != ChaincodeVersion || len(stored.Migrations) != 1 {
+		t.Errorf("Unexpected settings after upgrade %v", stored)
+	}
+
+	if stub.State[ownerKey] == nil {
+		t.Error("The owner index was not backfilled")
+	}
+
+	if carton, _ := (&CounterfeitCC{}).getCarton(stub, created.Carton.Id); carton.Owner != testdata.TestUser2CN {
+		t.Error("Legacy carton wasn't given to its producer: " + carton.Owner)
+	}
+
+	// given settings replace the stored ones, the others stay
+	if res := stub.MockInit("tx4", initArgs(`{"maxBatchSize": 5, "migrations": []}`)); res.Status != shim.OK {
+		t.Fatal("Upgrade with settings failed: " + res.Message)
+	}
+
+	json.Unmarshal(stub.State[KeySettings], &stored)
+	if stored.Admin != settings.Admin || stored.MaxBatchSize != 5 || len(stored.Migrations) != 1 {
+		t.Errorf("Unexpected settings after upgrade %v", stored)
+	}
+
+	if res := stub.MockInit("tx5", initArgs(`{"admin": ""}`)); res.Status == shim.OK {
+		t.Error("An upgrade must not drop the admin")
+	}
+
+	if res := stub.MockInit("tx6", initArgs(`{"admin": "otherUser"}`)); res.Status == shim.OK {
+		t.Error("An upgrade must not change the admin unless asked to")
+	}
+
+	if res := stub.MockInit("tx7", initArgs(`{"admin": "otherUser", "changeAdmin": true}`)); res.Status != shim.OK {
+		t.Fatal("Upgrade changing the admin failed: " + res.Message)
+	}
+
+	json.Unmarshal(stub.State[KeySettings], &stored)
+	if stored.Admin != "otherUser" || stored.MaxBatchSize != 5 {
+		t.Errorf("Unexpected settings after changing the admin %v", stored)
+	}
+}
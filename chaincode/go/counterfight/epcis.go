@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const EpcisContext = "https://ref.gs1.org/standards/epcis/2.0.0/epcis-context.jsonld"
+const EpcisSchemaVersion = "2.0"
+
+// prefix of the identifiers for objects and parties without a GS1 key
+const EpcisUriPrefix = "urn:counterfeit:"
+
+// GS1 Digital Link prefix of the identifiers with a GS1 key
+const DigitalLinkPrefix = "https://id.gs1.org/"
+
+// EPCIS event types and actions
+const EpcisObjectEvent = "ObjectEvent"
+const EpcisAggregationEvent = "AggregationEvent"
+const EpcisAdd = "ADD"
+const EpcisObserve = "OBSERVE"
+const EpcisDelete = "DELETE"
+
+// CBV business steps and dispositions used in the export
+const BizStepCommissioning = "commissioning"
+const BizStepPacking = "packing"
+const BizStepUnpacking = "unpacking"
+const BizStepShipping = "shipping"
+const BizStepReceiving = "receiving"
+const BizStepDispensing = "dispensing"
+const BizStepDestroying = "destroying"
+const DispositionActive = "active"
+const DispositionInProgress = "in_progress"
+const DispositionInTransit = "in_transit"
+const DispositionDispensed = "dispensed"
+const DispositionDestroyed = "destroyed"
+
+// CBV source and destination type
+const EpcisOwningParty = "owning_party"
+
+type EpcisDocument struct {
+	Context       []string  `json:"@context"`
+	Type          string    `json:"type"`
+	SchemaVersion string    `json:"schemaVersion"`
+	CreationDate  time.Time `json:"creationDate"`
+	Body          EpcisBody `json:"epcisBody"`
+}
+
+type EpcisBody struct {
+	EventList []EpcisEvent `json:"eventList"`
+}
+
+// EpcisEvent holds the fields of ObjectEvents and AggregationEvents the export uses
+type EpcisEvent struct {
+	Type                string             `json:"type"`
+	EventTime           time.Time          `json:"eventTime"`
+	EventTimeZoneOffset string             `json:"eventTimeZoneOffset"`
+	EpcList             []string           `json:"epcList,omitempty"`
+	ParentId            string             `json:"parentID,omitempty"`
+	ChildEpcs           []string           `json:"childEPCs,omitempty"`
+	Action              string             `json:"action"`
+	BizStep             string             `json:"bizStep"`
+	Disposition         string             `json:"disposition,omitempty"`
+	ReadPoint           *EpcisId           `json:"readPoint,omitempty"`
+	BizLocation         *EpcisId           `json:"bizLocation,omitempty"`
+	SourceList          []EpcisSource      `json:"sourceList,omitempty"`
+	DestinationList     []EpcisDestination `json:"destinationList,omitempty"`
+	Ilmd                *EpcisIlmd         `json:"ilmd,omitempty"`
+}
+
+type EpcisId struct {
+	Id string `json:"id"`
+}
+
+type EpcisSource struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+}
+
+type EpcisDestination struct {
+	Type        string `json:"type"`
+	Destination string `json:"destination"`
+}
+
+// EpcisIlmd is the master data of the commissioned instances
+type EpcisIlmd struct {
+	LotNumber          string `json:"cbvmda:lotNumber,omitempty"`
+	ItemExpirationDate string `json:"cbvmda:itemExpirationDate,omitempty"`
+}
+
+// digitalLinkEscape percent-encodes a key value of a GS1 Digital Link URI,
+// everything but the unreserved characters of RFC 3986
+func digitalLinkEscape(value string) string {
+	const hex = "0123456789ABCDEF"
+
+	escaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, '%', hex[c>>4], hex[c&15])
+		}
+	}
+
+	return string(escaped)
+}
+
+// packageEpc returns the GS1 Digital Link URI of a serialized package and a
+// private URI for packages with generated ids
+func packageEpc(carton Carton, packageId string) string {
+	if carton.Serialized {
+		return DigitalLinkPrefix + "01/" + gtin14(carton.Gtin) + "/21/" + digitalLinkEscape(packageId)
+	}
+
+	return EpcisUriPrefix + "package:" + carton.Id + ":" + packageId
+}
+
+func cartonEpc(cartonId string) string {
+	return EpcisUriPrefix + "carton:" + cartonId
+}
+
+func containerEpc(containerId string) string {
+	return EpcisUriPrefix + "container:" + containerId
+}
+
+func partyId(name string) string {
+	return EpcisUriPrefix + "party:" + name
+}
+
+// locationId is the GS1 Digital Link URI of a site, nil for goods handled without a site
+func locationId(gln string) *EpcisId {
+	if gln == "" {
+		return nil
+	}
+
+	return &EpcisId{Id: DigitalLinkPrefix + "414/" + gln}
+}
+
+// epcisSites finds the sites of the events among the stops of the carton
+type epcisSites []Stop
+
+// gln returns the site of the stop a transaction recorded for the party, or
+// else the site the party last handled the carton at before the time
+func (stops epcisSites) gln(txId string, event string, party string, at time.Time) string {
+	gln := ""
+	for _, stop := range stops {
+		if stop.Party != party || stop.Gln == "" {
+			continue
+		} else if stop.TxId == txId && stop.Event == event {
+			return stop.Gln
+		} else if !stop.Time.After(at) {
+			gln = stop.Gln
+		}
+	}
+
+	return gln
+}
+
+func newEpcisEvent(eventType string, time time.Time, action string, bizStep string, disposition string, gln string) EpcisEvent {
+	return EpcisEvent{
+		Type:                eventType,
+		EventTime:           time,
+		EventTimeZoneOffset: "+00:00",
+		Action:              action,
+		BizStep:             bizStep,
+		Disposition:         disposition,
+		ReadPoint:           locationId(gln),
+		BizLocation:         locationId(gln),
+	}
+}
+
+// handoverEvents describes a change of owner as shipping by the seller and receiving by the buyer
+func handoverEvents(epcs []string, time time.Time, txId string, seller string, buyer string, sites epcisSites) []EpcisEvent {
+	shipping := newEpcisEvent(EpcisObjectEvent, time, EpcisObserve, BizStepShipping, DispositionInTransit, sites.gln(txId, StopShipped, seller, time))
+	shipping.EpcList = epcs
+	shipping.SourceList = []EpcisSource{{Type: EpcisOwningParty, Source: partyId(seller)}}
+	shipping.DestinationList = []EpcisDestination{{Type: EpcisOwningParty, Destination: partyId(buyer)}}
+
+	receiving := newEpcisEvent(EpcisObjectEvent, time, EpcisObserve, BizStepReceiving, DispositionInProgress, sites.gln(txId, StopReceived, buyer, time))
+	receiving.EpcList = epcs
+	receiving.SourceList = shipping.SourceList
+	receiving.DestinationList = shipping.DestinationList
+
+	return []EpcisEvent{shipping, receiving}
+}
+
+// cartonEpcisEvents renders the commissioning of the packages, their packing
+// into the carton and the hand-overs of the whole carton
+func cartonEpcisEvents(carton Carton, history []HistoryEntry, packageIds []string, sites epcisSites) []EpcisEvent {
+	var epcs []string
+	for _, packageId := range packageIds {
+		epcs = append(epcs, packageEpc(carton, packageId))
+	}
+
+	var events []EpcisEvent
+	previous := ""
+	for _, entry := range history {
+		switch entry.Change {
+		case ChangeCreated:
+			gln := sites.gln(entry.TxId, StopCreated, entry.Owner, entry.Time)
+			commissioning := newEpcisEvent(EpcisObjectEvent, entry.Time, EpcisAdd, BizStepCommissioning, DispositionActive, gln)
+			commissioning.EpcList = epcs
+			commissioning.Ilmd = &EpcisIlmd{LotNumber: carton.Lot}
+			if !carton.ExpiryDate.IsZero() {
+				commissioning.Ilmd.ItemExpirationDate = carton.ExpiryDate.Format("2006-01-02")
+			}
+
+			packing := newEpcisEvent(EpcisAggregationEvent, entry.Time, EpcisAdd, BizStepPacking, DispositionInProgress, gln)
+			packing.ParentId = cartonEpc(carton.Id)
+			packing.ChildEpcs = epcs
+
+			events = append(events, commissioning, packing)
+		case ChangeTransferred, ChangeReturned:
+			events = append(events, handoverEvents([]string{cartonEpc(carton.Id)}, entry.Time, entry.TxId, previous, entry.Owner, sites)...)
+		}
+
+		previous = entry.Owner
+	}
+
+	return events
+}
+
+// packageEpcisEvents renders what happened to a single package: hand-overs of
+// the package alone, the sale and its destruction. history is the merged
+// history of the package and its carton.
+func packageEpcisEvents(carton Carton, packageId string, history []HistoryEntry, sites epcisSites) []EpcisEvent {
+	epcs := []string{packageEpc(carton, packageId)}
+
+	var events []EpcisEvent
+	owner := ""
+	for _, entry := range history {
+		if entry.Object == ObjectPackage {
+			switch entry.Change {
+			case ChangeTransferred:
+				if entry.Owner != owner {
+					events = append(events, handoverEvents(epcs, entry.Time, entry.TxId, owner, entry.Owner, sites)...)
+				}
+			case ChangeSold:
+				dispensing := newEpcisEvent(EpcisObjectEvent, entry.Time, EpcisObserve, BizStepDispensing, DispositionDispensed, sites.gln(entry.TxId, StopSold, entry.Owner, entry.Time))
+				dispensing.EpcList = epcs
+				events = append(events, dispensing)
+			case ChangeDestroyed:
+				destroying := newEpcisEvent(EpcisObjectEvent, entry.Time, EpcisObserve, BizStepDestroying, DispositionDestroyed, sites.gln(entry.TxId, "", entry.Owner, entry.Time))
+				destroying.EpcList = epcs
+				events = append(events, destroying)
+			}
+		}
+
+		owner = entry.Owner
+	}
+
+	return events
+}
+
+// ownerAt returns who held the carton at the time
+func ownerAt(cartonHistory []HistoryEntry, at time.Time) string {
+	owner := ""
+	for _, entry := range cartonHistory {
+		if entry.Time.After(at) {
+			break
+		}
+		owner = entry.Owner
+	}
+
+	return owner
+}
+
+// containmentEpcisEvents renders packing the carton into containers, and those
+// into bigger ones, and unpacking them again
+func containmentEpcisEvents(cartonId string, containment []ContainmentEntry, cartonHistory []HistoryEntry, sites epcisSites) []EpcisEvent {
+	var events []EpcisEvent
+	for _, entry := range containment {
+		child := containerEpc(entry.Content)
+		if entry.Content == cartonId {
+			child = cartonEpc(cartonId)
+		}
+
+		packer := ownerAt(cartonHistory, entry.Packed)
+		packing := newEpcisEvent(EpcisAggregationEvent, entry.Packed, EpcisAdd, BizStepPacking, DispositionInProgress, sites.gln("", "", packer, entry.Packed))
+		packing.ParentId = containerEpc(entry.ContainerId)
+		packing.ChildEpcs = []string{child}
+		events = append(events, packing)
+
+		if !entry.Unpacked.IsZero() {
+			unpacker := ownerAt(cartonHistory, entry.Unpacked)
+			unpacking := newEpcisEvent(EpcisAggregationEvent, entry.Unpacked, EpcisDelete, BizStepUnpacking, DispositionInProgress, sites.gln("", "", unpacker, entry.Unpacked))
+			unpacking.ParentId = packing.ParentId
+			unpacking.ChildEpcs = packing.ChildEpcs
+			events = append(events, unpacking)
+		}
+	}
+
+	return events
+}
+
+// exportEpcis renders the trail of a carton with all its packages, or of a
+// single package if one is given, as an EPCIS 2.0 JSON-LD document
+func (t *CounterfeitCC) exportEpcis(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := PackageRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing exportEpcis request json")
+	}
+
+	if ref.PackageId != "" || ref.Sgtin != "" {
+		ref, err = t.resolvePackageRef(stub, ref)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	carton, err := t.getCarton(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	packageIds := []string{ref.PackageId}
+	if ref.PackageId == "" {
+		packages, err := t.getCartonPackages(stub, carton.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		packageIds = []string{}
+		for _, pckg := range packages {
+			packageIds = append(packageIds, pckg.Id)
+		}
+	} else {
+		_, err = t.getPackage(stub, carton.Id, ref.PackageId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	cartonHistory, err := t.getCartonHistory(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	containment, err := t.getContainment(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stops, err := t.getCartonStops(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sites := epcisSites(stops)
+
+	events := cartonEpcisEvents(carton, cartonHistory, packageIds, sites)
+	events = append(events, containmentEpcisEvents(carton.Id, containment, cartonHistory, sites)...)
+
+	for _, packageId := range packageIds {
+		packageHistory, err := t.getPackageOwnHistory(stub, carton.Id, packageId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		events = append(events, packageEpcisEvents(carton, packageId, mergeHistory(cartonHistory, packageHistory), sites)...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventTime.Before(events[j].EventTime)
+	})
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	document := EpcisDocument{
+		Context:       []string{EpcisContext},
+		Type:          "EPCISDocument",
+		SchemaVersion: EpcisSchemaVersion,
+		CreationDate:  now,
+		Body:          EpcisBody{EventList: append([]EpcisEvent{}, events...)},
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return shim.Error("Error generating EPCIS document")
+	}
+
+	return shim.Success(data)
+}
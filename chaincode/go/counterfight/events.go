@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// name of the chaincode event every transaction sends its envelope under
+const EventName = "counterfeit"
+
+// version of the envelope and event schema, bumped on incompatible changes
+const EventVersion = 1
+
+// event types
+const EventCartonCreated = "carton.created"
+const EventTransferOffered = "transfer.offered"
+const EventTransferCompleted = "transfer.completed"
+const EventPackageSold = "package.sold"
+const EventRecallIssued = "recall.issued"
+const EventSuspiciousScan = "scan.suspicious"
+const EventExcursion = "coldchain.excursion"
+const EventQuarantineReleased = "coldchain.released"
+const EventAlertRaised = "alert.raised"
+
+// Event describes one change. Only the fields that apply to the type are set.
+type Event struct {
+	Type        string   `json:"type"`
+	Actor       string   `json:"actor"`
+	CartonId    string   `json:"cartonId,omitempty"`
+	PackageId   string   `json:"packageId,omitempty"`
+	PackageIds  []string `json:"packageIds,omitempty"`
+	ContainerId string   `json:"containerId,omitempty"`
+	TransferId  string   `json:"transferId,omitempty"`
+	Seller      string   `json:"seller,omitempty"`
+	Buyer       string   `json:"buyer,omitempty"`
+	RecallId    string   `json:"recallId,omitempty"`
+	Severity    string   `json:"severity,omitempty"`
+	CartonIds   []string `json:"cartonIds,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
+	Verdict     string   `json:"verdict,omitempty"`
+	AlertId     string   `json:"alertId,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+}
+
+// EventEnvelope carries all events of a transaction, as Fabric keeps only one
+// chaincode event per transaction
+type EventEnvelope struct {
+	Version int       `json:"version"`
+	TxId    string    `json:"txId"`
+	Time    time.Time `json:"time"`
+	Events  []Event   `json:"events"`
+}
+
+// eventStub wraps the stub of one invocation and collects its events
+type eventStub struct {
+	shim.ChaincodeStubInterface
+	envelope *EventEnvelope
+}
+
+func newEventStub(stub shim.ChaincodeStubInterface) *eventStub {
+	return &eventStub{ChaincodeStubInterface: stub}
+}
+
+// emitEvent adds the event to the envelope of the transaction and sets the
+// envelope as the chaincode event again, the last one set is the one sent.
+// Outside of Invoke the event goes out in an envelope of its own.
+func emitEvent(stub shim.ChaincodeStubInterface, event Event) error {
+	events, ok := stub.(*eventStub)
+	if !ok {
+		events = newEventStub(stub)
+	}
+
+	if events.envelope == nil {
+		now, err := txTime(stub)
+		if err != nil {
+			return err
+		}
+
+		events.envelope = &EventEnvelope{
+			Version: EventVersion,
+			TxId:    stub.GetTxID(),
+			Time:    now,
+			Events:  []Event{},
+		}
+	}
+
+	events.envelope.Events = append(events.envelope.Events, event)
+
+	data, err := json.Marshal(events.envelope)
+	if err != nil {
+		return errors.New("Error marshaling event: " + err.Error())
+	}
+
+	err = events.ChaincodeStubInterface.SetEvent(EventName, data)
+	if err != nil {
+		return errors.New("Error sending event: " + err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type ExpiryQuery struct {
+	Days int `json:"days"`
+}
+
+// the longest look ahead of listExpiringCartons, about a hundred years
+const MaxExpiryDays = 36500
+
+// validateCarton checks the product data a producer supplies for a new carton
+func validateCarton(carton Carton) error {
+	if carton.Name == "" {
+		return errors.New("A carton needs a name")
+	}
+
+	if carton.PackageNum < 1 {
+		return errors.New("A carton needs at least one package")
+	}
+
+	err := validateGtin(carton.Gtin)
+	if err != nil {
+		return err
+	}
+
+	err = validateLot(carton.Lot)
+	if err != nil {
+		return err
+	}
+
+	if !carton.ExpiryDate.After(carton.ProductionDate) {
+		return errors.New("The expiry date must be after the production date")
+	}
+
+	for _, territory := range carton.Territories {
+		if !countryPattern.MatchString(territory) {
+			return errors.New("Territory '" + territory + "' must be an ISO 3166 alpha-2 code")
+		}
+	}
+
+	return validateStorage(carton.Storage)
+}
+
+// checkNotExpired refuses goods past their expiry date. Cartons created before
+// expiry dates were recorded have none and never expire.
+func checkNotExpired(stub shim.ChaincodeStubInterface, carton Carton) error {
+	if carton.ExpiryDate.IsZero() {
+		return nil
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	if !now.Before(carton.ExpiryDate) {
+		return errors.New("Carton " + carton.Id + " expired on " + carton.ExpiryDate.Format("2006-01-02"))
+	}
+
+	return nil
+}
+
+// listExpiringCartons returns the caller's cartons and the cartons it holds
+// single packages of that expire within the given number of days, already
+// expired ones included, soonest first
+func (t *CounterfeitCC) listExpiringCartons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	query := ExpiryQuery{}
+	err = json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return shim.Error("Error parsing expiry query json")
+	}
+
+	if query.Days < 0 || query.Days > MaxExpiryDays {
+		return shim.Error("days must be between 0 and " + uintToString(MaxExpiryDays))
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	until := now.AddDate(0, 0, query.Days)
+
+	cartonIds, err := t.heldCartonIds(stub, caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var cartons []Carton = []Carton{}
+	for _, cartonId := range cartonIds {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if !carton.ExpiryDate.IsZero() && !carton.ExpiryDate.After(until) {
+			cartons = append(cartons, carton)
+		}
+	}
+
+	sort.SliceStable(cartons, func(i, j int) bool {
+		return cartons[i].ExpiryDate.Before(cartons[j].ExpiryDate)
+	})
+
+	data, err := json.Marshal(cartons)
+	if err != nil {
+		return shim.Error("Error generating expiring cartons response")
+	}
+
+	return shim.Success(data)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"counterfight/tagcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// GS1 AI 10, batch or lot number: up to 20 characters
+var lotPattern = regexp.MustCompile(`^[0-9A-Za-z\-./]{1,20}$`)
+
+// GS1 AI 21, serial number: up to 20 characters of GS1 character set 82
+var serialPattern = regexp.MustCompile(`^[!"%&'()*+,\-./0-9:;<=>?A-Z_a-z]{1,20}$`)
+
+// application identifiers of the element strings on a package
+const AiGtin = "01"
+const AiLot = "10"
+const AiExpiry = "17"
+const AiSerial = "21"
+
+// separator ending a variable length element in an unbracketed element string
+const GroupSeparator = "\x1d"
+
+// (gtin14, serial) -> PackageRef, each SGTIN exists once on the ledger
+const IndexSgtin = "cn~sgtin"
+
+// Gs1Data holds the elements of a GS1 element string. Expiry is zero if AI 17 was missing.
+type Gs1Data struct {
+	Gtin   string    `json:"gtin"`
+	Serial string    `json:"serial,omitempty"`
+	Lot    string    `json:"lot,omitempty"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// gs1CheckDigit computes the GS1 mod 10 check digit over the digits of a key without its check digit
+func gs1CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+// validateGtin accepts GTIN-8, -12, -13 and -14 with a correct check digit
+func validateGtin(gtin string) error {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return errors.New("GTIN '" + gtin + "' must have 8, 12, 13 or 14 digits")
+	}
+
+	for i := 0; i < len(gtin); i++ {
+		if gtin[i] < '0' || gtin[i] > '9' {
+			return errors.New("GTIN '" + gtin + "' must only contain digits")
+		}
+	}
+
+	if gs1CheckDigit(gtin[:len(gtin)-1]) != gtin[len(gtin)-1] {
+		return errors.New("GTIN '" + gtin + "' has a wrong check digit")
+	}
+
+	return nil
+}
+
+func validateLot(lot string) error {
+	if !lotPattern.MatchString(lot) {
+		return errors.New("Lot '" + lot + "' must be 1 to 20 letters, digits or -./")
+	}
+
+	return nil
+}
+
+func validateSerial(serial string) error {
+	if !serialPattern.MatchString(serial) {
+		return errors.New("Serial '" + serial + "' must be 1 to 20 characters of GS1 character set 82")
+	}
+
+	return nil
+}
+
+// gtin14 pads a GTIN to the 14 digits it has in element strings and keys
+func gtin14(gtin string) string {
+	return strings.Repeat("0", 14-len(gtin)) + gtin
+}
+
+// sgtinKey returns the key a GTIN and serial are indexed under
+func sgtinKey(stub shim.ChaincodeStubInterface, gtin string, serial string) string {
+	key, _ := stub.CreateCompositeKey(IndexSgtin, []string{gtin14(gtin), serial})
+	return key
+}
+
+// parseExpiry reads an AI 17 date, YYMMDD, where day 00 means the last day
+// of the month. The century is chosen as GS1 asks: the year lies at most 49
+// years before and 50 years after now.
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if len(value) != 6 || strings.Trim(value, "0123456789") != "" {
+		return time.Time{}, errors.New("Expiry date '" + value + "' must be YYMMDD")
+	}
+
+	number := func(i int) int {
+		return int(value[i]-'0')*10 + int(value[i+1]-'0')
+	}
+
+	year := now.Year() - now.Year()%100 + number(0)
+	if year-now.Year() > 50 {
+		year -= 100
+	} else if now.Year()-year > 49 {
+		year += 100
+	}
+
+	month := time.Month(number(2))
+	day := number(4)
+	if month < 1 || month > 12 {
+		return time.Time{}, errors.New("Expiry date '" + value + "' has no month " + value[2:4])
+	}
+
+	if day == 0 {
+		return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if date.Day() != day {
+		return time.Time{}, errors.New("Expiry date '" + value + "' has no day " + value[4:])
+	}
+
+	return date, nil
+}
+
+// parseElementString reads a GS1 element string with the AIs 01, 21, 10 and
+// 17, either human readable with the AIs in brackets or as it is encoded in
+// a barcode, where variable length elements not at the end are followed by
+// a group separator. AI 01 is required, the others are optional.
+func parseElementString(elements string, now time.Time) (Gs1Data, error) {
+	values := map[string]string{}
+
+	set := func(ai string, value string) error {
+		if _, ok := values[ai]; ok {
+			return errors.New("AI " + ai + " appears twice")
+		}
+		values[ai] = value
+		return nil
+	}
+
+	if strings.HasPrefix(elements, "(") {
+		for _, part := range strings.Split(elements[1:], "(") {
+			end := strings.Index(part, ")")
+			if end < 0 {
+				return Gs1Data{}, errors.New("Unclosed AI in '" + elements + "'")
+			}
+
+			err := set(part[:end], part[end+1:])
+			if err != nil {
+				return Gs1Data{}, err
+			}
+		}
+	} else {
+		rest := strings.TrimPrefix(elements, GroupSeparator)
+		for rest != "" {
+			if len(rest) < 2 {
+				return Gs1Data{}, errors.New("Truncated element string '" + elements + "'")
+			}
+
+			ai := rest[:2]
+			rest = rest[2:]
+
+			var value string
+			switch ai {
+			case AiGtin, AiExpiry:
+				length := 14
+				if ai == AiExpiry {
+					length = 6
+				}
+				if len(rest) < length {
+					return Gs1Data{}, errors.New("AI " + ai + " is too short")
+				}
+				value, rest = rest[:length], rest[length:]
+			case AiLot, AiSerial:
+				end := strings.Index(rest, GroupSeparator)
+				if end < 0 {
+					value, rest = rest, ""
+				} else {
+					value, rest = rest[:end], rest[end+1:]
+				}
+			default:
+				return Gs1Data{}, errors.New("Unsupported AI " + ai)
+			}
+
+			err := set(ai, value)
+			if err != nil {
+				return Gs1Data{}, err
+			}
+		}
+	}
+
+	data := Gs1Data{}
+	for ai, value := range values {
+		var err error
+		switch ai {
+		case AiGtin:
+			if len(value) != 14 {
+				return Gs1Data{}, errors.New("AI 01 must have 14 digits")
+			}
+			data.Gtin, err = value, validateGtin(value)
+		case AiSerial:
+			data.Serial, err = value, validateSerial(value)
+		case AiLot:
+			data.Lot, err = value, validateLot(value)
+		case AiExpiry:
+			data.Expiry, err = parseExpiry(value, now)
+		default:
+			err = errors.New("Unsupported AI " + ai)
+		}
+		if err != nil {
+			return Gs1Data{}, err
+		}
+	}
+
+	if data.Gtin == "" {
+		return Gs1Data{}, errors.New("The element string has no GTIN (AI 01)")
+	}
+
+	return data, nil
+}
+
+// validateSerials checks the serials a producer supplies for the packages of a
+// carton and claims their SGTINs, so no other package in this transaction or
+// on the ledger can have them
+func validateSerials(ids *idGenerator, carton Carton) error {
+	if len(carton.Serials) != carton.PackageNum {
+		return errors.New("A carton of " + strconv.Itoa(carton.PackageNum) + " packages needs as many serials")
+	}
+
+	for _, serial := range carton.Serials {
+		err := validateSerial(serial)
+		if err != nil {
+			return err
+		}
+
+		err = ids.claim(sgtinKey(ids.stub, carton.Gtin, serial))
+		if err != nil {
+			return errors.New("SGTIN " + gtin14(carton.Gtin) + "." + serial + " is already taken")
+		}
+	}
+
+	return nil
+}
+
+// putSgtin registers the package under its GTIN and serial, which is its package id
+func (t *CounterfeitCC) putSgtin(stub shim.ChaincodeStubInterface, gtin string, ref PackageRef) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return errors.New("Error marshaling SGTIN: " + err.Error())
+	}
+
+	err = stub.PutState(sgtinKey(stub, gtin, ref.PackageId), data)
+	if err != nil {
+		return errors.New("Error storing SGTIN: " + err.Error())
+	}
+
+	return nil
+}
+
+// findSgtin returns the package registered under the GTIN and serial
+func (t *CounterfeitCC) findSgtin(stub shim.ChaincodeStubInterface, gtin string, serial string) (PackageRef, error) {
+	data, err := stub.GetState(sgtinKey(stub, gtin, serial))
+	if err != nil {
+		return PackageRef{}, errors.New("Error getting SGTIN: " + err.Error())
+	} else if data == nil {
+		return PackageRef{}, errors.New("No package with SGTIN " + gtin14(gtin) + "." + serial)
+	}
+
+	ref := PackageRef{}
+	err = json.Unmarshal(data, &ref)
+	if err != nil {
+		return PackageRef{}, errors.New("Error parsing SGTIN json: " + err.Error())
+	}
+
+	return ref, nil
+}
+
+// parsePackageRef reads a package reference argument, either PackageRef json
+// or just the code printed on the package
+func parsePackageRef(arg string) (PackageRef, error) {
+	if !strings.HasPrefix(strings.TrimSpace(arg), "{") {
+		return PackageRef{Code: arg}, nil
+	}
+
+	ref := PackageRef{}
+	err := json.Unmarshal([]byte(arg), &ref)
+	return ref, err
+}
+
+// resolvePackageRef turns a reference by element string or tag code into the
+// carton and package ids. The lot and expiry date in the element string have
+// to match the carton. The site, position and signature of the reference are
+// kept.
+func (t *CounterfeitCC) resolvePackageRef(stub shim.ChaincodeStubInterface, ref PackageRef) (PackageRef, error) {
+	if ref.Code != "" {
+		return t.resolveTagCode(stub, ref)
+	} else if ref.Sgtin == "" {
+		if ref.CartonId == "" || ref.PackageId == "" {
+			return PackageRef{}, errors.New("cartonId and packageId or sgtin are required")
+		}
+		return ref, nil
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	data, err := parseElementString(ref.Sgtin, now)
+	if err != nil {
+		return PackageRef{}, err
+	} else if data.Serial == "" {
+		return PackageRef{}, errors.New("The element string has no serial (AI 21)")
+	}
+
+	resolved, err := t.findSgtin(stub, data.Gtin, data.Serial)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	carton, err := t.getCarton(stub, resolved.CartonId)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	err = checkGs1Data(carton, data)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	resolved.Site = ref.Site
+	resolved.Geo = ref.Geo
+	resolved.Signature = ref.Signature
+	return resolved, nil
+}
+
+// resolveTagCode reads the ids of a tag code. GS1 data in the code has to
+// match the carton, a signature in it takes the place of one in the reference.
+func (t *CounterfeitCC) resolveTagCode(stub shim.ChaincodeStubInterface, ref PackageRef) (PackageRef, error) {
+	tag, err := tagcode.Decode(ref.Code)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	resolved := PackageRef{
+		CartonId:  tag.CartonId,
+		PackageId: tag.PackageId,
+		Site:      ref.Site,
+		Geo:       ref.Geo,
+		Signature: ref.Signature,
+	}
+
+	if len(tag.Signature) > 0 {
+		resolved.Signature = base64.StdEncoding.EncodeToString(tag.Signature)
+	}
+
+	if !tag.HasGs1() {
+		return resolved, nil
+	}
+
+	carton, err := t.getCarton(stub, tag.CartonId)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	data := Gs1Data{Gtin: tag.Gtin, Serial: tag.Serial, Lot: tag.Lot}
+	if tag.Expiry != "" {
+		now, err := txTime(stub)
+		if err != nil {
+			return PackageRef{}, err
+		}
+
+		data.Expiry, err = parseExpiry(tag.Expiry, now)
+		if err != nil {
+			return PackageRef{}, err
+		}
+	}
+
+	if data.Gtin != "" && gtin14(data.Gtin) != gtin14(carton.Gtin) {
+		return PackageRef{}, errors.New("GTIN " + data.Gtin + " doesn't match the package")
+	} else if data.Serial != "" && data.Serial != tag.PackageId {
+		return PackageRef{}, errors.New("Serial " + data.Serial + " doesn't match the package")
+	}
+
+	err = checkGs1Data(carton, data)
+	if err != nil {
+		return PackageRef{}, err
+	}
+
+	return resolved, nil
+}
+
+// checkGs1Data makes sure the lot and expiry date read off a package are the carton's
+func checkGs1Data(carton Carton, data Gs1Data) error {
+	if data.Lot != "" && data.Lot != carton.Lot {
+		return errors.New("Lot " + data.Lot + " doesn't match the package")
+	}
+
+	// AI 17 only has the day, the carton the exact time
+	if !data.Expiry.IsZero() && !sameDay(data.Expiry, carton.ExpiryDate) {
+		return errors.New("Expiry date doesn't match the package")
+	}
+
+	return nil
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	a, b = a.UTC(), b.UTC()
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// lookupSgtin returns the carton and package id of a GS1 element string
+func (t *CounterfeitCC) lookupSgtin(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := PackageRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing lookupSgtin request json")
+	}
+
+	if ref.Sgtin == "" {
+		return shim.Error("sgtin is required")
+	}
+
+	resolved, err := t.resolvePackageRef(stub, ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return shim.Error("Error generating SGTIN response")
+	}
+
+	return shim.Success(data)
+}
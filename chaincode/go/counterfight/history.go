@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// object a history entry is about
+const ObjectCarton = "carton"
+const ObjectPackage = "package"
+
+// change types of a history entry
+const ChangeCreated = "created"
+const ChangeTransferred = "transferred"
+const ChangeSold = "sold"
+const ChangeUpdated = "updated"
+const ChangeDeleted = "deleted"
+const ChangeReturned = "returned"
+const ChangeRestocked = "restocked"
+const ChangeDestroyed = "destroyed"
+
+// getModifications reads the whole history of a key
+func (t *CounterfeitCC) getModifications(stub shim.ChaincodeStubInterface, key string) ([]*queryresult.KeyModification, error) {
+	historyIter, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, errors.New("Error getting history: " + err.Error())
+	}
+	defer historyIter.Close()
+
+	var result []*queryresult.KeyModification
+	for historyIter.HasNext() {
+		modification, err := historyIter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading history: " + err.Error())
+		}
+
+		result = append(result, modification)
+	}
+
+	return result, nil
+}
+
+func newHistoryEntry(modification *queryresult.KeyModification, object string) HistoryEntry {
+	entry := HistoryEntry{
+		TxId:     modification.TxId,
+		Object:   object,
+		IsDelete: modification.IsDelete,
+	}
+
+	if modification.Timestamp != nil {
+		entry.Timestamp = modification.Timestamp.Seconds
+		entry.Time = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+	}
+
+	return entry
+}
+
+// getCartonHistory decodes every version of the carton into an owner and a change type
+func (t *CounterfeitCC) getCartonHistory(stub shim.ChaincodeStubInterface, cartonId string) ([]HistoryEntry, error) {
+	key, _ := stub.CreateCompositeKey(IndexCartons, []string{cartonId})
+	modifications, err := t.getModifications(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []HistoryEntry = []HistoryEntry{}
+	var previous *Carton
+	for _, modification := range modifications {
+		entry := newHistoryEntry(modification, ObjectCarton)
+
+		if modification.IsDelete {
+			entry.Change = ChangeDeleted
+			if previous != nil {
+				entry.Owner = previous.Owner
+			}
+			previous = nil
+			history = append(history, entry)
+			continue
+		}
+
+		carton := Carton{}
+		err = json.Unmarshal(modification.Value, &carton)
+		if err != nil {
+			return nil, errors.New("Error parsing carton json in tx " + modification.TxId + ": " + err.Error())
+		}
+
+		entry.Owner = carton.Owner
+		switch {
+		case previous == nil:
+			entry.Change = ChangeCreated
+		case previous.Owner != carton.Owner:
+			entry.Change = ChangeTransferred
+		default:
+			entry.Change = ChangeUpdated
+		}
+
+		previous = &carton
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+// getPackageOwnHistory decodes every version of the package key. A package
+// following its carton has no owner of its own, mergeHistory fills it in.
+func (t *CounterfeitCC) getPackageOwnHistory(stub shim.ChaincodeStubInterface, cartonId string, packageId string) ([]HistoryEntry, error) {
+	key, _ := stub.CreateCompositeKey(IndexPackage, []string{cartonId, packageId})
+	modifications, err := t.getModifications(stub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []HistoryEntry = []HistoryEntry{}
+	var previous *Package
+	for _, modification := range modifications {
+		entry := newHistoryEntry(modification, ObjectPackage)
+
+		if modification.IsDelete {
+			entry.Change = ChangeDeleted
+			previous = nil
+			history = append(history, entry)
+			continue
+		}
+
+		pckg := Package{}
+		err = json.Unmarshal(modification.Value, &pckg)
+		if err != nil {
+			return nil, errors.New("Error parsing package json in tx " + modification.TxId + ": " + err.Error())
+		}
+		migratePackage(&pckg)
+
+		entry.State = pckg.State
+		entry.Owner = pckg.Owner
+		switch {
+		case previous == nil:
+			entry.Change = ChangeCreated
+		case previous.State != PackageDispensed && pckg.State == PackageDispensed:
+			entry.Change = ChangeSold
+		case previous.State != PackageReturned && pckg.State == PackageReturned:
+			entry.Change = ChangeReturned
+		case previous.State == PackageReturned && pckg.State == PackageInDistribution:
+			entry.Change = ChangeRestocked
+		case previous.State != PackageDestroyed && pckg.State == PackageDestroyed:
+			entry.Change = ChangeDestroyed
+		case previous.Owner != pckg.Owner:
+			entry.Change = ChangeTransferred
+		default:
+			entry.Change = ChangeUpdated
+		}
+
+		previous = &pckg
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+
+// mergeHistory orders carton and package entries by time. Within one
+// transaction the carton comes first. Package entries without an owner of
+// their own get the owner the carton had at that moment. Once the package
+// has an owner of its own, the carton entries no longer concern it and are
+// left out until the package follows its carton again.
+func mergeHistory(cartonHistory []HistoryEntry, packageHistory []HistoryEntry) []HistoryEntry {
+	history := append(append([]HistoryEntry{}, cartonHistory...), packageHistory...)
+
+	sort.SliceStable(history, func(i, j int) bool {
+		if !history[i].Time.Equal(history[j].Time) {
+			return history[i].Time.Before(history[j].Time)
+		}
+		return history[i].Object == ObjectCarton && history[j].Object != ObjectCarton
+	})
+
+	var result []HistoryEntry = []HistoryEntry{}
+	owner := ""
+	detached := false
+	for _, entry := range history {
+		if entry.Object == ObjectCarton {
+			owner = entry.Owner
+			if detached {
+				continue
+			}
+		} else {
+			detached = entry.Owner != ""
+			if !detached {
+				entry.Owner = owner
+			}
+		}
+
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+// getOwnerHistory returns the merged timeline of a package and its carton
+func (t *CounterfeitCC) getOwnerHistory(stub shim.ChaincodeStubInterface, cartonId string, packageId string) ([]HistoryEntry, error) {
+	cartonHistory, err := t.getCartonHistory(stub, cartonId)
+	if err != nil {
+		return nil, err
+	}
+
+	packageHistory, err := t.getPackageOwnHistory(stub, cartonId, packageId)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeHistory(cartonHistory, packageHistory), nil
+}
+
+// markReturns labels the owner changes made by accepting one of the returns,
+// which would otherwise look like transfers
+func markReturns(history []HistoryEntry, returns []ReturnRequest) []HistoryEntry {
+	accepted := map[string]bool{}
+	for _, request := range returns {
+		if request.AcceptTxId != "" {
+			accepted[request.AcceptTxId] = true
+		}
+	}
+
+	for i := range history {
+		if history[i].Change == ChangeTransferred && accepted[history[i].TxId] {
+			history[i].Change = ChangeReturned
+		}
+	}
+
+	return history
+}
+
+// cartonHistory returns the owners of a carton and its returns
+func (t *CounterfeitCC) cartonHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := PackageRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing getCartonHistory request json")
+	}
+
+	carton, err := t.getCarton(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	history, err := t.getCartonHistory(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	returns, err := t.getCartonReturns(stub, ref.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response := CartonHistoryResponse{
+		Carton:       carton,
+		OwnerHistory: markReturns(history, returns),
+		Returns:      returns,
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Error generating carton history response")
+	}
+
+	return shim.Success(data)
+}
+
+// ContainmentEntry says that a carton or container was packed into a container for a while
+type ContainmentEntry struct {
+	ContainerId string    `json:"containerId"`
+	Type        string    `json:"type"`
+	Content     string    `json:"content"`
+	TxId        string    `json:"txId"`
+	Packed      time.Time `json:"packed"`
+	Unpacked    time.Time `json:"unpacked"`
+}
+
+// getContainment follows the parent of the carton through its history, and the
+// parents of those containers through theirs, to give the chain of containers
+// the carton travelled in. Unpacked is zero while the content is still packed.
+func (t *CounterfeitCC) getContainment(stub shim.ChaincodeStubInterface, cartonId string) ([]ContainmentEntry, error) {
+	type subject struct {
+		key string
+		id  string
+	}
+
+	cartonKey, _ := stub.CreateCompositeKey(IndexCartons, []string{cartonId})
+	queue := []subject{{key: cartonKey, id: cartonId}}
+	visited := map[string]bool{}
+
+	var result []ContainmentEntry = []ContainmentEntry{}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		modifications, err := t.getModifications(stub, current.key)
+		if err != nil {
+			return nil, err
+		}
+
+		open := -1
+		for _, modification := range modifications {
+			entry := newHistoryEntry(modification, "")
+
+			// cartons and containers both call the container they are packed in parent
+			value := struct {
+				Parent string `json:"parent"`
+			}{}
+			if !modification.IsDelete {
+				err = json.Unmarshal(modification.Value, &value)
+				if err != nil {
+					return nil, errors.New("Error parsing json in tx " + modification.TxId + ": " + err.Error())
+				}
+			}
+
+			if open >= 0 && result[open].ContainerId == value.Parent {
+				continue
+			}
+
+			if open >= 0 {
+				result[open].Unpacked = entry.Time
+				open = -1
+			}
+
+			if value.Parent == "" {
+				continue
+			}
+
+			containerType := ""
+			container, err := t.getContainer(stub, value.Parent)
+			if err == nil {
+				containerType = container.Type
+			}
+
+			result = append(result, ContainmentEntry{
+				ContainerId: value.Parent,
+				Type:        containerType,
+				Content:     current.id,
+				TxId:        modification.TxId,
+				Packed:      entry.Time,
+			})
+			open = len(result) - 1
+
+			if !visited[value.Parent] {
+				visited[value.Parent] = true
+				containerKey, _ := stub.CreateCompositeKey(IndexContainer, []string{value.Parent})
+				queue = append(queue, subject{key: containerKey, id: value.Parent})
+			}
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Packed.Before(result[j].Packed)
+	})
+
+	return result, nil
+}
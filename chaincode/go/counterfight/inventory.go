@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// (owner, cartonId) -> the cartons a participant holds and
+// (owner, cartonId, packageId) -> the packages it holds apart from their carton,
+// both sort by carton id
+const IndexOwner = "cn~owner"
+
+// page sizes of the paginated lists
+const DefaultPageSize = 20
+const MaxPageSize = 100
+
+// InventoryQuery asks for the next page of the caller's cartons after Bookmark,
+// optionally only those of a product or those with packages left to sell
+type InventoryQuery struct {
+	PageSize  int    `json:"pageSize,omitempty"`
+	Bookmark  string `json:"bookmark,omitempty"`
+	Name      string `json:"name,omitempty"`
+	HasUnsold bool   `json:"hasUnsold,omitempty"`
+}
+
+// CartonPage is one page of cartons. Bookmark is empty on the last page.
+type CartonPage struct {
+	Cartons  []Carton `json:"cartons"`
+	Bookmark string   `json:"bookmark"`
+}
+
+// indexCartonOwner moves the carton from the old owner's inventory to the new one's
+func (t *CounterfeitCC) indexCartonOwner(stub shim.ChaincodeStubInterface, cartonId string, oldOwner string, newOwner string) error {
+	if oldOwner == newOwner {
+		return nil
+	}
+
+	if oldOwner != "" {
+		key, _ := stub.CreateCompositeKey(IndexOwner, []string{oldOwner, cartonId})
+		err := stub.DelState(key)
+		if err != nil {
+			return errors.New("Error updating owner index: " + err.Error())
+		}
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexOwner, []string{newOwner, cartonId})
+	err := stub.PutState(key, indexValue)
+	if err != nil {
+		return errors.New("Error updating owner index: " + err.Error())
+	}
+
+	return nil
+}
+
+// indexPackageOwner moves a package between the inventories of its own owners,
+// an empty owner means the package follows its carton and has no entry
+func (t *CounterfeitCC) indexPackageOwner(stub shim.ChaincodeStubInterface, cartonId string, packageId string, oldOwner string, newOwner string) error {
+	if oldOwner == newOwner {
+		return nil
+	}
+
+	if oldOwner != "" {
+		key, _ := stub.CreateCompositeKey(IndexOwner, []string{oldOwner, cartonId, packageId})
+		err := stub.DelState(key)
+		if err != nil {
+			return errors.New("Error updating owner index: " + err.Error())
+		}
+	}
+
+	if newOwner != "" {
+		key, _ := stub.CreateCompositeKey(IndexOwner, []string{newOwner, cartonId, packageId})
+		err := stub.PutState(key, indexValue)
+		if err != nil {
+			return errors.New("Error updating owner index: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ownerRange returns the keys of the owner's inventory that start past the
+// entries of the bookmark carton, so a page doesn't scan the ones before it
+func ownerRange(stub shim.ChaincodeStubInterface, owner string, bookmark string) (string, string) {
+	prefix, _ := stub.CreateCompositeKey(IndexOwner, []string{owner})
+	if bookmark == "" {
+		return prefix, prefix + string(utf8.MaxRune)
+	}
+
+	start, _ := stub.CreateCompositeKey(IndexOwner, []string{owner, bookmark})
+	return start + string(utf8.MaxRune), prefix + string(utf8.MaxRune)
+}
+
+// heldCartonIds returns the ids of the cartons the owner holds or holds single
+// packages of, in id order
+func (t *CounterfeitCC) heldCartonIds(stub shim.ChaincodeStubInterface, owner string) ([]string, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexOwner, []string{owner})
+	if err != nil {
+		return nil, errors.New("Error listing cartons: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []string = []string{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error listing cartons: " + err.Error())
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) < 2 {
+			return nil, errors.New("Error parsing owner index key")
+		}
+
+		if len(result) == 0 || result[len(result)-1] != attributes[1] {
+			result = append(result, attributes[1])
+		}
+	}
+
+	return result, nil
+}
+
+// hasUnsoldPackages says whether the owner still holds a package of the carton it can sell
+func (t *CounterfeitCC) hasUnsoldPackages(stub shim.ChaincodeStubInterface, carton Carton, owner string) (bool, error) {
+	packages, err := t.getCartonPackages(stub, carton.Id)
+	if err != nil {
+		return false, err
+	}
+
+	for _, pckg := range packages {
+		if packageOwner(carton, pckg) != owner {
+			continue
+		}
+
+		if pckg.State == PackageCreated || pckg.State == PackageInDistribution {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// listMyCartons pages through the caller's cartons in id order, together with
+// the cartons the caller holds single packages of. The bookmark is the id of
+// the last carton of the previous page.
+func (t *CounterfeitCC) listMyCartons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("expected at most 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	query := InventoryQuery{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &query)
+		if err != nil {
+			return shim.Error("Error parsing inventory query json")
+		}
+	}
+
+	query.PageSize, err = checkPageSize(query.PageSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iter, err := stub.GetStateByRange(ownerRange(stub, caller, query.Bookmark))
+	if err != nil {
+		return shim.Error("Error listing cartons: " + err.Error())
+	}
+	defer iter.Close()
+
+	page := CartonPage{Cartons: []Carton{}}
+	previous := ""
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error("Error listing cartons: " + err.Error())
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) < 2 {
+			return shim.Error("Error parsing owner index key")
+		}
+
+		// the entries of a carton and of its packages follow each other
+		cartonId := attributes[1]
+		if cartonId == previous {
+			continue
+		}
+		previous = cartonId
+
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if query.Name != "" && carton.Name != query.Name {
+			continue
+		}
+
+		if query.HasUnsold {
+			unsold, err := t.hasUnsoldPackages(stub, carton, caller)
+			if err != nil {
+				return shim.Error(err.Error())
+			} else if !unsold {
+				continue
+			}
+		}
+
+		// one match past a full page means there is another page
+		if len(page.Cartons) == query.PageSize {
+			page.Bookmark = page.Cartons[len(page.Cartons)-1].Id
+			break
+		}
+
+		page.Cartons = append(page.Cartons, carton)
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Error generating carton list response")
+	}
+
+	return shim.Success(data)
+}
+
+// PackageCounts sums up the packages of a carton by sale status and by state
+type PackageCounts struct {
+	Total   int            `json:"total"`
+	Sold    int            `json:"sold"`
+	Unsold  int            `json:"unsold"`
+	ByState map[string]int `json:"byState"`
+}
+
+// CartonDetails is a carton with the counts of its packages
+type CartonDetails struct {
+	Carton Carton        `json:"carton"`
+	Counts PackageCounts `json:"counts"`
+}
+
+// PackageQuery asks for the next page of a carton's packages after Bookmark
+type PackageQuery struct {
+	CartonId string `json:"cartonId"`
+	PageSize int    `json:"pageSize,omitempty"`
+	Bookmark string `json:"bookmark,omitempty"`
+}
+
+// PackagePage is one page of packages with the counts of the whole carton.
+// Bookmark is empty on the last page.
+type PackagePage struct {
+	CartonId string        `json:"cartonId"`
+	Packages []Package     `json:"packages"`
+	Counts   PackageCounts `json:"counts"`
+	Bookmark string        `json:"bookmark"`
+}
+
+// add counts the package. Packages that are returned, recalled or destroyed are
+// neither sold nor for sale.
+func (c *PackageCounts) add(pckg Package) {
+	c.Total++
+	c.ByState[pckg.State]++
+
+	switch pckg.State {
+	case PackageDispensed:
+		c.Sold++
+	case PackageCreated, PackageInDistribution:
+		c.Unsold++
+	}
+}
+
+func newPackageCounts() PackageCounts {
+	return PackageCounts{ByState: map[string]int{}}
+}
+
+// checkPageSize applies the default and the limit of page sizes
+func checkPageSize(pageSize int) (int, error) {
+	if pageSize < 0 || pageSize > MaxPageSize {
+		return 0, errors.New("pageSize must be between 0 and " + uintToString(MaxPageSize))
+	} else if pageSize == 0 {
+		return DefaultPageSize, nil
+	}
+
+	return pageSize, nil
+}
+
+// getCartonDetails returns the carton with the counts of its packages
+func (t *CounterfeitCC) getCartonDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	query := PackageQuery{}
+	err := json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return shim.Error("Error parsing getCarton request json")
+	}
+
+	carton, err := t.getCarton(stub, query.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	packages, err := t.getCartonPackages(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	details := CartonDetails{Carton: carton, Counts: newPackageCounts()}
+	for _, pckg := range packages {
+		details.Counts.add(pckg)
+	}
+
+	data, err := json.Marshal(details)
+	if err != nil {
+		return shim.Error("Error generating carton response")
+	}
+
+	return shim.Success(data)
+}
+
+// listPackages pages through the packages of a carton in id order. The
+// bookmark is the id of the last package of the previous page. The counts
+// always cover the whole carton.
+func (t *CounterfeitCC) listPackages(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	query := PackageQuery{}
+	err := json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return shim.Error("Error parsing listPackages request json")
+	}
+
+	query.PageSize, err = checkPageSize(query.PageSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.getCarton(stub, query.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(IndexPackage, []string{query.CartonId})
+	if err != nil {
+		return shim.Error("Error listing packages: " + err.Error())
+	}
+	defer iter.Close()
+
+	page := PackagePage{CartonId: query.CartonId, Packages: []Package{}, Counts: newPackageCounts()}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error("Error listing packages: " + err.Error())
+		}
+
+		pckg := Package{}
+		err = json.Unmarshal(kv.Value, &pckg)
+		if err != nil {
+			return shim.Error("Error parsing package json: " + err.Error())
+		}
+		migratePackage(&pckg)
+
+		page.Counts.add(pckg)
+
+		if query.Bookmark != "" && pckg.Id <= query.Bookmark {
+			continue
+		}
+
+		if len(page.Packages) == query.PageSize {
+			page.Bookmark = page.Packages[len(page.Packages)-1].Id
+			continue
+		}
+
+		page.Packages = append(page.Packages, pckg)
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Error generating package list response")
+	}
+
+	return shim.Success(data)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ProducerKey is a public key a producer signs its package tags with.
+// PublicKey is PEM encoded PKIX, Id is derived from it.
+type ProducerKey struct {
+	Id         string    `json:"id"`
+	Producer   string    `json:"producer"`
+	PublicKey  string    `json:"publicKey"`
+	Status     string    `json:"status"`
+	Registered time.Time `json:"registered"`
+	Retired    time.Time `json:"retired"`
+}
+
+// KeyRequest registers a public key, or the key of the caller's enrollment
+// certificate if PublicKey is empty, or revokes the key with KeyId
+type KeyRequest struct {
+	PublicKey string `json:"publicKey,omitempty"`
+	KeyId     string `json:"keyId,omitempty"`
+}
+
+type ProducerRef struct {
+	Producer string `json:"producer"`
+}
+
+// PackageSignatures holds the producer's signatures of packages of a carton
+// by package id, made with the key KeyId or else the active key
+type PackageSignatures struct {
+	CartonId   string            `json:"cartonId"`
+	KeyId      string            `json:"keyId,omitempty"`
+	Signatures map[string]string `json:"signatures"`
+}
+
+// (producer, keyId) -> ProducerKey
+const IndexProducerKey = "cn~producerkey"
+
+// status of a producer key. A retired key was rotated out, the tags it signed
+// of packages made before stay valid. The tags of a revoked key don't.
+const KeyActive = "active"
+const KeyRetired = "retired"
+const KeyRevoked = "revoked"
+
+// result of checking a scanned tag signature
+const SignatureValid = "valid"
+const SignatureInvalid = "invalid"
+
+// packageSignatureData is what a producer signs for a package tag: the
+// carton id, package id, GTIN and lot, one per line
+func packageSignatureData(cartonId string, packageId string, gtin string, lot string) []byte {
+	return []byte(strings.Join([]string{cartonId, packageId, gtin, lot}, "\n"))
+}
+
+// keyId is the hex of the first 8 bytes of the SHA-256 of the DER encoded key
+func keyId(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", errors.New("Error encoding public key: " + err.Error())
+	}
+
+	digest := sha256.Sum256(der)
+	return hex.EncodeToString(digest[:8]), nil
+}
+
+func parsePublicKey(keyPEM string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("Failed to parse PEM public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("Failed to parse public key: " + err.Error())
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Only ECDSA keys are supported")
+	}
+
+	return ecdsaKey, nil
+}
+
+func (t *CounterfeitCC) getProducerKeys(stub shim.ChaincodeStubInterface, producer string) ([]ProducerKey, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexProducerKey, []string{producer})
+	if err != nil {
+		return nil, errors.New("Error getting producer keys: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []ProducerKey = []ProducerKey{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading producer keys: " + err.Error())
+		}
+
+		key := ProducerKey{}
+		err = json.Unmarshal(kv.Value, &key)
+		if err != nil {
+			return nil, errors.New("Error parsing producer key json: " + err.Error())
+		}
+
+		result = append(result, key)
+	}
+
+	return result, nil
+}
+
+func (t *CounterfeitCC) putProducerKey(stub shim.ChaincodeStubInterface, key ProducerKey) error {
+	stateKey, _ := stub.CreateCompositeKey(IndexProducerKey, []string{key.Producer, key.Id})
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return errors.New("Error marshaling producer key: " + err.Error())
+	}
+
+	err = stub.PutState(stateKey, data)
+	if err != nil {
+		return errors.New("Error storing producer key: " + err.Error())
+	}
+
+	return nil
+}
+
+// addProducerKey makes the key the producer's active one, the one active so far is retired
+func (t *CounterfeitCC) addProducerKey(stub shim.ChaincodeStubInterface, producer string, publicKey *ecdsa.PublicKey) (ProducerKey, error) {
+	id, err := keyId(publicKey)
+	if err != nil {
+		return ProducerKey{}, err
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(publicKey)
+	now, err := txTime(stub)
+	if err != nil {
+		return ProducerKey{}, err
+	}
+
+	keys, err := t.getProducerKeys(stub, producer)
+	if err != nil {
+		return ProducerKey{}, err
+	}
+
+	for _, key := range keys {
+		if key.Id == id {
+			return ProducerKey{}, errors.New("Key " + id + " is already registered")
+		}
+
+		if key.Status == KeyActive {
+			key.Status = KeyRetired
+			key.Retired = now
+			err = t.putProducerKey(stub, key)
+			if err != nil {
+				return ProducerKey{}, err
+			}
+		}
+	}
+
+	key := ProducerKey{
+		Id:         id,
+		Producer:   producer,
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Status:     KeyActive,
+		Registered: now,
+	}
+
+	return key, t.putProducerKey(stub, key)
+}
+
+// enrollmentKey returns the public key of the caller's enrollment certificate
+func enrollmentKey(stub shim.ChaincodeStubInterface) (*ecdsa.PublicKey, error) {
+	cert, err := CallerCert(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The enrollment certificate has no ECDSA key")
+	}
+
+	return publicKey, nil
+}
+
+// signingKey returns the key the producer signs with: the one asked for or
+// the active one. A producer without keys gets the key of its enrollment
+// certificate registered.
+func (t *CounterfeitCC) signingKey(stub shim.ChaincodeStubInterface, producer string, id string) (ProducerKey, error) {
+	keys, err := t.getProducerKeys(stub, producer)
+	if err != nil {
+		return ProducerKey{}, err
+	}
+
+	if len(keys) == 0 {
+		publicKey, err := enrollmentKey(stub)
+		if err != nil {
+			return ProducerKey{}, err
+		}
+
+		return t.addProducerKey(stub, producer, publicKey)
+	}
+
+	for _, key := range keys {
+		if id == "" && key.Status == KeyActive || id != "" && key.Id == id {
+			if key.Status != KeyActive {
+				return ProducerKey{}, errors.New("Key " + key.Id + " is " + key.Status)
+			}
+			return key, nil
+		}
+	}
+
+	if id == "" {
+		return ProducerKey{}, errors.New("No active key for " + producer)
+	}
+
+	return ProducerKey{}, errors.New("No key " + id + " for " + producer)
+}
+
+// checkPackageSignature checks a scanned tag signature against the keys of
+// the producer. Revoked keys are left out, rotated out keys only count for
+// cartons made before they were retired.
+func (t *CounterfeitCC) checkPackageSignature(stub shim.ChaincodeStubInterface, carton Carton, packageId string, signature string) (string, error) {
+	keys, err := t.getProducerKeys(stub, carton.Producer)
+	if err != nil {
+		return "", err
+	}
+
+	data := packageSignatureData(carton.Id, packageId, carton.Gtin, carton.Lot)
+	for _, key := range keys {
+		if key.Status == KeyRevoked {
+			continue
+		} else if key.Status == KeyRetired && !carton.ProductionDate.Before(key.Retired) {
+			continue
+		}
+
+		publicKey, err := parsePublicKey(key.PublicKey)
+		if err != nil {
+			return "", err
+		}
+
+		if verifyECDSA(publicKey, data, signature) == nil {
+			return SignatureValid, nil
+		}
+	}
+
+	return SignatureInvalid, nil
+}
+
+// registerKey adds a signing key of the calling producer and retires the previous one
+func (t *CounterfeitCC) registerKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("expected at most 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request := KeyRequest{}
+	if len(args) == 1 {
+		err = json.Unmarshal([]byte(args[0]), &request)
+		if err != nil {
+			return shim.Error("Error parsing registerKey request json")
+		}
+	}
+
+	var publicKey *ecdsa.PublicKey
+	if request.PublicKey != "" {
+		publicKey, err = parsePublicKey(request.PublicKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		publicKey, err = enrollmentKey(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	key, err := t.addProducerKey(stub, user.Name, publicKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return shim.Error("Error generating producer key response")
+	}
+
+	return shim.Success(data)
+}
+
+// revokeKey withdraws a compromised key, the tags signed with it no longer verify
+func (t *CounterfeitCC) revokeKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request := KeyRequest{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing revokeKey request json")
+	}
+
+	keys, err := t.getProducerKeys(stub, user.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, key := range keys {
+		if key.Id != request.KeyId {
+			continue
+		} else if key.Status == KeyRevoked {
+			return shim.Error("Key " + key.Id + " is already revoked")
+		}
+
+		key.Status = KeyRevoked
+		key.Retired, err = txTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		err = t.putProducerKey(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		data, err := json.Marshal(key)
+		if err != nil {
+			return shim.Error("Error generating producer key response")
+		}
+
+		return shim.Success(data)
+	}
+
+	return shim.Error("No key " + request.KeyId + " for " + user.Name)
+}
+
+// listProducerKeys returns all keys of a producer, so tags can be checked without the ledger
+func (t *CounterfeitCC) listProducerKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := ProducerRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing getProducerKeys request json")
+	}
+
+	keys, err := t.getProducerKeys(stub, ref.Producer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return shim.Error("Error generating producer key list response")
+	}
+
+	return shim.Success(data)
+}
+
+// signPackages stores the producer's tag signatures of packages it hasn't
+// shipped yet. Packages aren't signed when their carton is created: the
+// chaincode can't hold the producer's private key, so the producer signs the
+// tags off the ledger once createCarton has returned the ids, and the
+// signatures are checked against the signing key here.
+func (t *CounterfeitCC) signPackages(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request := PackageSignatures{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing signPackages request json")
+	}
+
+	if len(request.Signatures) == 0 {
+		return shim.Error("signatures are required")
+	}
+
+	carton, err := t.getCarton(stub, request.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if carton.Producer != user.Name {
+		return shim.Error("Carton " + carton.Id + " wasn't produced by " + user.Name)
+	}
+
+	key, err := t.signingKey(stub, user.Name, request.KeyId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	publicKey, err := parsePublicKey(key.PublicKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// map order differs between peers, the response must not
+	var packageIds []string
+	for packageId := range request.Signatures {
+		packageIds = append(packageIds, packageId)
+	}
+	sort.Strings(packageIds)
+
+	var result []Package = []Package{}
+	for _, packageId := range packageIds {
+		signature := request.Signatures[packageId]
+		pckg, err := t.getPackage(stub, carton.Id, packageId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if pckg.State != PackageCreated {
+			return shim.Error("Package " + carton.Id + ":" + packageId + " has already left the producer")
+		}
+
+		err = verifyECDSA(publicKey, packageSignatureData(carton.Id, packageId, carton.Gtin, carton.Lot), signature)
+		if err != nil {
+			return shim.Error("Package " + carton.Id + ":" + packageId + ": " + err.Error())
+		}
+
+		pckg.Signature = signature
+		pckg.KeyId = key.Id
+		err = t.putPackage(stub, carton.Id, pckg)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		result = append(result, pckg)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating response")
+	}
+
+	return shim.Success(data)
+}
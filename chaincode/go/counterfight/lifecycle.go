@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// lifecycle states of a package
+const PackageCreated = "created"
+const PackageInDistribution = "in-distribution"
+const PackageDispensed = "dispensed"
+const PackageReturned = "returned"
+const PackageRecalled = "recalled"
+const PackageDestroyed = "destroyed"
+
+// PackageTransitions maps a package state to the states it may move to.
+// Every state change goes through transitionPackage, which checks this table.
+var PackageTransitions = map[string][]string{
+	PackageCreated:        {PackageInDistribution, PackageDispensed, PackageRecalled, PackageDestroyed},
+	PackageInDistribution: {PackageDispensed, PackageReturned, PackageRecalled, PackageDestroyed},
+	PackageDispensed:      {PackageRecalled},
+	PackageReturned:       {PackageInDistribution, PackageRecalled, PackageDestroyed},
+	PackageRecalled:       {PackageDestroyed},
+	PackageDestroyed:      {},
+}
+
+// TransitionError is returned for a state change the transition table doesn't allow
+type TransitionError struct {
+	CartonId  string
+	PackageId string
+	From      string
+	To        string
+}
+
+func (e *TransitionError) Error() string {
+	return "Package " + e.CartonId + ":" + e.PackageId + " is " + e.From + " and can't become " + e.To
+}
+
+// UnknownStateError is returned for a state that isn't in the transition table
+type UnknownStateError struct {
+	State string
+}
+
+func (e *UnknownStateError) Error() string {
+	return "Unknown package state '" + e.State + "'"
+}
+
+// migratePackage fills in the state of packages stored before the lifecycle
+// existed, which only knew whether they were sold, and keeps Sold in step
+// with the state for clients that still read it
+func migratePackage(pckg *Package) {
+	if pckg.State == "" {
+		if pckg.Sold {
+			pckg.State = PackageDispensed
+		} else {
+			pckg.State = PackageCreated
+		}
+	}
+
+	pckg.Sold = pckg.State == PackageDispensed
+}
+
+func checkTransition(cartonId string, pckg Package, to string) error {
+	allowed, ok := PackageTransitions[pckg.State]
+	if !ok {
+		return &UnknownStateError{State: pckg.State}
+	}
+
+	if _, ok := PackageTransitions[to]; !ok {
+		return &UnknownStateError{State: to}
+	}
+
+	if !contains(allowed, to) {
+		return &TransitionError{CartonId: cartonId, PackageId: pckg.Id, From: pckg.State, To: to}
+	}
+
+	return nil
+}
+
+// transitionPackage moves the package to the state if the transition table allows it
+func (t *CounterfeitCC) transitionPackage(stub shim.ChaincodeStubInterface, cartonId string, pckg Package, to string) (Package, error) {
+	err := checkTransition(cartonId, pckg, to)
+	if err != nil {
+		return Package{}, err
+	}
+
+	if to == PackageDispensed {
+		pckg.SellDate, err = txTime(stub)
+		if err != nil {
+			return Package{}, err
+		}
+	}
+
+	pckg.State = to
+	migratePackage(&pckg)
+
+	return pckg, t.putPackage(stub, cartonId, pckg)
+}
+
+func (t *CounterfeitCC) putPackage(stub shim.ChaincodeStubInterface, cartonId string, pckg Package) error {
+	key, _ := stub.CreateCompositeKey(IndexPackage, []string{cartonId, pckg.Id})
+
+	data, err := json.Marshal(pckg)
+	if err != nil {
+		return errors.New("Error marshaling package object: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing package: " + err.Error())
+	}
+
+	return nil
+}
+
+// distributeCarton moves the packages that haven't left the producer yet into distribution
+func (t *CounterfeitCC) distributeCarton(stub shim.ChaincodeStubInterface, cartonId string) error {
+	packages, err := t.getCartonPackages(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	for _, pckg := range packages {
+		if pckg.State != PackageCreated {
+			continue
+		}
+
+		_, err = t.transitionPackage(stub, cartonId, pckg, PackageInDistribution)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -17,8 +17,14 @@ limitations under the License.
 package mock
 
 import (
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/msp"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -27,13 +33,23 @@ type FullMockStub struct {
 
 	cc          shim.Chaincode
 	mockCreator []byte
+	writeSet    map[string][]byte
+	txTimestamp *timestamp.Timestamp
+	history     map[string][]*queryresult.KeyModification
+	event       *pb.ChaincodeEvent
 }
 
+// transaction timestamp used until a test calls MockTxTimestamp
+var DefaultTxTime = time.Date(2017, time.November, 1, 12, 0, 0, 0, time.UTC)
+
 func NewFullMockStub(name string, cc shim.Chaincode) *FullMockStub {
 	s := shim.NewMockStub(name, cc)
 	fs := new(FullMockStub)
 	fs.MockStub = *s
 	fs.cc = cc
+	fs.writeSet = map[string][]byte{}
+	fs.history = map[string][]*queryresult.KeyModification{}
+	fs.MockTxTimestamp(DefaultTxTime)
 	return fs
 }
 
@@ -41,10 +57,17 @@ func (stub *FullMockStub) MockCreator(mspID string, cert string) {
 	stub.mockCreator, _ = msp.NewSerializedIdentity(mspID, []byte(cert))
 }
 
+// sets the timestamp returned by GetTxTimestamp for the following transactions
+func (stub *FullMockStub) MockTxTimestamp(t time.Time) {
+	stub.txTimestamp, _ = ptypes.TimestampProto(t)
+}
+
 func (stub *FullMockStub) MockInit(uuid string, args [][]byte) pb.Response {
 	// this is a hack here to set MockStub.args, because its not accessible otherwise
 	stub.MockStub.MockInvoke(uuid, args)
 
+	stub.writeSet = map[string][]byte{}
+	stub.event = nil
 	stub.MockTransactionStart(uuid)
 	res := stub.cc.Init(stub)
 	stub.MockTransactionEnd(uuid)
@@ -57,6 +80,8 @@ func (stub *FullMockStub) MockInvoke(uuid string, args [][]byte) pb.Response {
 	stub.MockStub.MockInvoke(uuid, args)
 
 	// now do the invoke with the correct stub
+	stub.writeSet = map[string][]byte{}
+	stub.event = nil
 	stub.MockTransactionStart(uuid)
 	res := stub.cc.Invoke(stub)
 	stub.MockTransactionEnd(uuid)
@@ -67,3 +92,83 @@ func (stub *FullMockStub) MockInvoke(uuid string, args [][]byte) pb.Response {
 func (stub *FullMockStub) GetCreator() ([]byte, error) {
 	return stub.mockCreator, nil
 }
+
+func (stub *FullMockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return stub.txTimestamp, nil
+}
+
+func (stub *FullMockStub) PutState(key string, value []byte) error {
+	err := stub.MockStub.PutState(key, value)
+	if err == nil {
+		stub.writeSet[key] = value
+		stub.recordHistory(key, value, false)
+	}
+	return err
+}
+
+func (stub *FullMockStub) DelState(key string) error {
+	err := stub.MockStub.DelState(key)
+	if err == nil {
+		stub.writeSet[key] = nil
+		stub.recordHistory(key, nil, true)
+	}
+	return err
+}
+
+func (stub *FullMockStub) recordHistory(key string, value []byte, isDelete bool) {
+	stub.history[key] = append(stub.history[key], &queryresult.KeyModification{
+		TxId:      stub.TxID,
+		Value:     value,
+		Timestamp: stub.txTimestamp,
+		IsDelete:  isDelete,
+	})
+}
+
+// returns every value written to the key by this stub, oldest first
+func (stub *FullMockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &MockHistoryQueryIterator{modifications: stub.history[key]}, nil
+}
+
+// keeps the event like the peer does: a transaction sends the last one it set
+func (stub *FullMockStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("Event name can not be nil string.")
+	}
+
+	stub.event = &pb.ChaincodeEvent{TxId: stub.TxID, EventName: name, Payload: payload}
+	return nil
+}
+
+// returns the event set by the last MockInit or MockInvoke or nil
+func (stub *FullMockStub) ChaincodeEvent() *pb.ChaincodeEvent {
+	return stub.event
+}
+
+// returns the keys written by the last MockInit or MockInvoke, deleted keys map to nil
+func (stub *FullMockStub) WriteSet() map[string][]byte {
+	return stub.writeSet
+}
+
+type MockHistoryQueryIterator struct {
+	modifications []*queryresult.KeyModification
+	closed        bool
+}
+
+func (iter *MockHistoryQueryIterator) HasNext() bool {
+	return !iter.closed && len(iter.modifications) > 0
+}
+
+func (iter *MockHistoryQueryIterator) Next() (*queryresult.KeyModification, error) {
+	if !iter.HasNext() {
+		return nil, errors.New("MockHistoryQueryIterator.Next() called when it does not HaveNext()")
+	}
+
+	modification := iter.modifications[0]
+	iter.modifications = iter.modifications[1:]
+	return modification, nil
+}
+
+func (iter *MockHistoryQueryIterator) Close() error {
+	iter.closed = true
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// pseudo roles for the permission table
+const AnyCaller = "*"
+const RoleAdmin = "admin"
+
+// Permissions maps every Invoke function to the roles allowed to call it.
+// A function missing here can't be called at all.
+var Permissions = map[string][]string{
+	"info":          {AnyCaller},
+	"createUser":    {AnyCaller},
+	"approveUser":   {RoleAdmin},
+	"rejectUser":    {RoleAdmin},
+	"suspendUser":   {RoleAdmin},
+	"reinstateUser": {RoleAdmin},
+	"getUser":       {AnyCaller},
+	"listUsers":     {AnyCaller},
+
+	"createCarton":        {RoleProducer},
+	"createCartons":       {RoleProducer},
+	"sellCarton":          {RoleProducer, RoleReseller},
+	"offerTransfer":       {RoleProducer, RoleReseller},
+	"sellCartons":         {RoleProducer, RoleReseller},
+	"transferPackages":    {RoleProducer, RoleReseller},
+	"acceptTransfer":      {RoleReseller, RolePharmacy},
+	"rejectTransfer":      {RoleReseller, RolePharmacy},
+	"cancelTransfer":      {RoleProducer, RoleReseller},
+	"getTransfer":         {RoleProducer, RoleReseller, RolePharmacy},
+	"listTransfers":       {RoleProducer, RoleReseller, RolePharmacy},
+	"sellPackage":         {RolePharmacy},
+	"getPackageHistory":   {AnyCaller},
+	"getCartonHistory":    {AnyCaller},
+	"exportEpcis":         {AnyCaller},
+	"verifyPackage":       {AnyCaller},
+	"lookupSgtin":         {AnyCaller},
+	"listExpiringCartons": {RoleProducer, RoleReseller, RolePharmacy},
+	"listMyCartons":       {RoleProducer, RoleReseller, RolePharmacy},
+	"getCarton":           {RoleProducer, RoleReseller, RolePharmacy},
+	"listPackages":        {RoleProducer, RoleReseller, RolePharmacy},
+	"createContainer":     {RoleProducer, RoleReseller},
+	"aggregate":           {RoleProducer, RoleReseller},
+	"disaggregate":        {RoleProducer, RoleReseller, RolePharmacy},
+	"getContainer":        {RoleProducer, RoleReseller, RolePharmacy},
+	"issueRecall":         {RoleProducer},
+	"getRecall":           {AnyCaller},
+	"listRecalls":         {AnyCaller},
+	"requestReturn":       {RoleReseller, RolePharmacy},
+	"acceptReturn":        {RoleProducer, RoleReseller},
+	"rejectReturn":        {RoleProducer, RoleReseller},
+	"completeReturn":      {RoleProducer, RoleReseller},
+	"getReturn":           {RoleProducer, RoleReseller, RolePharmacy},
+	"listReturns":         {RoleProducer, RoleReseller, RolePharmacy},
+	"registerSite":        {RoleProducer, RoleReseller, RolePharmacy},
+	"getSite":             {AnyCaller},
+	"getRoute":            {AnyCaller},
+	"listAlerts":          {RoleProducer, RoleAdmin},
+	"triageAlert":         {RoleProducer, RoleAdmin},
+	"registerKey":         {RoleProducer},
+	"revokeKey":           {RoleProducer},
+	"getProducerKeys":     {AnyCaller},
+	"signPackages":        {RoleProducer},
+	"registerSensor":      {RoleAdmin},
+	"submitReadings":      {RoleProducer, RoleReseller, RolePharmacy},
+	"getColdChain":        {RoleProducer, RoleReseller, RolePharmacy},
+	"releaseQuarantine":   {RoleProducer},
+}
+
+// Flows maps the role of a seller to the roles it may hand goods to
+var Flows = map[string][]string{
+	RoleProducer: {RoleReseller, RolePharmacy},
+	RoleReseller: {RoleReseller, RolePharmacy},
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the caller against the permission table entry of the function
+func (t *CounterfeitCC) authorize(stub shim.ChaincodeStubInterface, function string) error {
+	roles, ok := Permissions[function]
+	if !ok {
+		return errors.New("Incorrect function name: " + function)
+	}
+
+	if contains(roles, AnyCaller) {
+		return nil
+	}
+
+	if contains(roles, RoleAdmin) {
+		err := t.checkAdmin(stub)
+		if err == nil || len(roles) == 1 {
+			return err
+		}
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return err
+	}
+
+	if !contains(roles, user.Role) {
+		return errors.New("A " + user.Role + " can't call " + function)
+	}
+
+	return nil
+}
+
+// checkFlow makes sure the buyer is an active participant that may receive goods from the seller
+func (t *CounterfeitCC) checkFlow(stub shim.ChaincodeStubInterface, seller User, buyerName string) (User, error) {
+	if buyerName == seller.Name {
+		return User{}, errors.New("Can't sell to yourself")
+	}
+
+	buyer, err := t.findUser(stub, buyerName)
+	if err != nil {
+		return User{}, errors.New("Buyer '" + buyerName + "' is not registered")
+	}
+
+	if buyer.Status != UserApproved {
+		return User{}, errors.New("Buyer '" + buyerName + "' is " + buyer.Status)
+	}
+
+	if !contains(Flows[seller.Role], buyer.Role) {
+		return User{}, errors.New("A " + seller.Role + " can't hand goods to a " + buyer.Role)
+	}
+
+	return buyer, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Recall pulls cartons of a producer off the market. The scope is either a
+// list of cartons or a product name and/or lot with an optional production
+// date range.
+type Recall struct {
+	Id           string    `json:"id"`
+	Producer     string    `json:"producer"`
+	Reason       string    `json:"reason"`
+	Severity     string    `json:"severity"`
+	CartonIds    []string  `json:"cartonIds,omitempty"`
+	Product      string    `json:"product,omitempty"`
+	Lot          string    `json:"lot,omitempty"`
+	ProducedFrom time.Time `json:"producedFrom"`
+	ProducedTo   time.Time `json:"producedTo"`
+	Issued       time.Time `json:"issued"`
+	Cartons      []string  `json:"cartons"`
+}
+
+type RecallResponse struct {
+	Recall Recall   `json:"recall"`
+	Owners []string `json:"owners"`
+}
+
+type RecallRef struct {
+	RecallId string `json:"recallId"`
+}
+
+const IndexRecall = "cn~recall"
+
+// (cartonId, recallId) -> recalls a carton is part of
+const IndexCartonRecall = "cn~cartonrecall"
+
+// recall severity, class 1 is the most serious
+const SeverityClass1 = "class-1"
+const SeverityClass2 = "class-2"
+const SeverityClass3 = "class-3"
+
+var Severities = []string{SeverityClass1, SeverityClass2, SeverityClass3}
+
+// recallCovers tells whether a carton of the recalling producer is in the scope of the recall
+func recallCovers(recall Recall, carton Carton) bool {
+	if len(recall.CartonIds) > 0 {
+		return contains(recall.CartonIds, carton.Id)
+	}
+
+	if recall.Product == "" && recall.Lot == "" {
+		return false
+	}
+
+	if recall.Product != "" && carton.Name != recall.Product {
+		return false
+	}
+
+	if recall.Lot != "" && carton.Lot != recall.Lot {
+		return false
+	}
+
+	if !recall.ProducedFrom.IsZero() && carton.ProductionDate.Before(recall.ProducedFrom) {
+		return false
+	}
+
+	if !recall.ProducedTo.IsZero() && carton.ProductionDate.After(recall.ProducedTo) {
+		return false
+	}
+
+	return true
+}
+
+func validateRecall(recall Recall) error {
+	if recall.Reason == "" {
+		return errors.New("A recall needs a reason")
+	}
+
+	if !contains(Severities, recall.Severity) {
+		return errors.New("Unknown recall severity '" + recall.Severity + "'")
+	}
+
+	if len(recall.CartonIds) == 0 && recall.Product == "" && recall.Lot == "" {
+		return errors.New("A recall needs cartonIds, a product or a lot")
+	}
+
+	if len(recall.CartonIds) > 0 && (recall.Product != "" || recall.Lot != "") {
+		return errors.New("A recall covers either cartonIds or a product and lot, not both")
+	}
+
+	return nil
+}
+
+// issueRecall recalls the producer's cartons in scope together with all their
+// packages and notifies the current owners of both through a chaincode event
+func (t *CounterfeitCC) issueRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recall := Recall{}
+	err = json.Unmarshal([]byte(args[0]), &recall)
+	if err != nil {
+		return shim.Error("Error parsing recall json")
+	}
+
+	err = validateRecall(recall)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cartons, err := t.getProducerCartons(stub, user.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var affected []Carton
+	for _, carton := range cartons {
+		if recallCovers(recall, carton) {
+			affected = append(affected, carton)
+		}
+	}
+
+	if len(recall.CartonIds) > 0 && len(affected) != len(recall.CartonIds) {
+		return shim.Error("Some of the cartons don't exist or aren't yours")
+	} else if len(affected) == 0 {
+		return shim.Error("The recall doesn't cover any carton")
+	}
+
+	recall.Id, err = newIdGenerator(stub).nextFree(IndexRecall)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recall.Producer = user.Name
+	recall.Issued, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recall.Cartons = []string{}
+	for _, carton := range affected {
+		err = t.recallCarton(stub, recall.Id, carton.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		recall.Cartons = append(recall.Cartons, carton.Id)
+	}
+
+	err = t.putRecall(stub, recall)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owners, err := t.recallOwners(stub, affected)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response := RecallResponse{
+		Recall: recall,
+		Owners: owners,
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Error generating recall response")
+	}
+
+	err = emitEvent(stub, Event{
+		Type:      EventRecallIssued,
+		Actor:     user.Name,
+		RecallId:  recall.Id,
+		Severity:  recall.Severity,
+		CartonIds: recall.Cartons,
+		Owners:    response.Owners,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(data)
+}
+
+// recallCarton moves every package of the carton that isn't destroyed yet to recalled
+func (t *CounterfeitCC) recallCarton(stub shim.ChaincodeStubInterface, recallId string, cartonId string) error {
+	packages, err := t.getCartonPackages(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	for _, pckg := range packages {
+		if pckg.State == PackageRecalled || pckg.State == PackageDestroyed {
+			continue
+		}
+
+		_, err = t.transitionPackage(stub, cartonId, pckg, PackageRecalled)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexCartonRecall, []string{cartonId, recallId})
+	err = stub.PutState(key, indexValue)
+	if err != nil {
+		return errors.New("Error indexing recall: " + err.Error())
+	}
+
+	return nil
+}
+
+// cartonRecall returns the id of a recall covering the carton or "" if there is none
+func (t *CounterfeitCC) cartonRecall(stub shim.ChaincodeStubInterface, cartonId string) (string, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexCartonRecall, []string{cartonId})
+	if err != nil {
+		return "", errors.New("Error getting recalls: " + err.Error())
+	}
+	defer iter.Close()
+
+	if !iter.HasNext() {
+		return "", nil
+	}
+
+	kv, err := iter.Next()
+	if err != nil {
+		return "", errors.New("Error reading recalls: " + err.Error())
+	}
+
+	_, attributes, err := stub.SplitCompositeKey(kv.Key)
+	if err != nil || len(attributes) != 2 {
+		return "", errors.New("Error parsing recall key")
+	}
+
+	return attributes[1], nil
+}
+
+// checkNotRecalled refuses goods of a recalled carton
+func (t *CounterfeitCC) checkNotRecalled(stub shim.ChaincodeStubInterface, cartonId string) error {
+	recallId, err := t.cartonRecall(stub, cartonId)
+	if err != nil {
+		return err
+	} else if recallId != "" {
+		return errors.New("Carton " + cartonId + " is recalled by recall " + recallId)
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) putRecall(stub shim.ChaincodeStubInterface, recall Recall) error {
+	key, _ := stub.CreateCompositeKey(IndexRecall, []string{recall.Id})
+
+	data, err := json.Marshal(recall)
+	if err != nil {
+		return errors.New("Error marshaling recall: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing recall: " + err.Error())
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) loadRecall(stub shim.ChaincodeStubInterface, recallId string) (Recall, error) {
+	key, _ := stub.CreateCompositeKey(IndexRecall, []string{recallId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return Recall{}, errors.New("Error getting recall: " + err.Error())
+	} else if data == nil {
+		return Recall{}, errors.New("No recall for " + recallId)
+	}
+
+	recall := Recall{}
+	err = json.Unmarshal(data, &recall)
+	if err != nil {
+		return Recall{}, errors.New("Error parsing recall json: " + err.Error())
+	}
+
+	return recall, nil
+}
+
+// recallResponse adds the current owners of the recalled goods, they change as goods move on
+func (t *CounterfeitCC) recallResponse(stub shim.ChaincodeStubInterface, recall Recall) (RecallResponse, error) {
+	var cartons []Carton
+	for _, cartonId := range recall.Cartons {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return RecallResponse{}, err
+		}
+		cartons = append(cartons, carton)
+	}
+
+	owners, err := t.recallOwners(stub, cartons)
+	if err != nil {
+		return RecallResponse{}, err
+	}
+
+	return RecallResponse{Recall: recall, Owners: owners}, nil
+}
+
+func (t *CounterfeitCC) getRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := RecallRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing recall request json")
+	}
+
+	recall, err := t.loadRecall(stub, ref.RecallId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response, err := t.recallResponse(stub, recall)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Error generating recall response")
+	}
+
+	return shim.Success(data)
+}
+
+// listRecalls returns all recalls or, given a producer argument, the recalls of that producer
+func (t *CounterfeitCC) listRecalls(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("expected at most 1 argument")
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(IndexRecall, []string{})
+	if err != nil {
+		return shim.Error("Error listing recalls: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []RecallResponse = []RecallResponse{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error("Error listing recalls: " + err.Error())
+		}
+
+		recall := Recall{}
+		err = json.Unmarshal(kv.Value, &recall)
+		if err != nil {
+			return shim.Error("Error parsing recall json: " + err.Error())
+		}
+
+		if len(args) == 1 && args[0] != "" && recall.Producer != args[0] {
+			continue
+		}
+
+		response, err := t.recallResponse(stub, recall)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		result = append(result, response)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating recall list response")
+	}
+
+	return shim.Success(data)
+}
+
+// recallOwners returns the owners of the cartons and of their packages that
+// have an owner of their own
+func (t *CounterfeitCC) recallOwners(stub shim.ChaincodeStubInterface, cartons []Carton) ([]string, error) {
+	owners := []string{}
+	for _, carton := range cartons {
+		if !contains(owners, carton.Owner) {
+			owners = append(owners, carton.Owner)
+		}
+
+		packages, err := t.getCartonPackages(stub, carton.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pckg := range packages {
+			if pckg.Owner != "" && !contains(owners, pckg.Owner) {
+				owners = append(owners, pckg.Owner)
+			}
+		}
+	}
+	sort.Strings(owners)
+
+	return owners, nil
+}
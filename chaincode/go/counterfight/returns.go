@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ReturnRequest sends some packages of a carton, or the whole carton if no
+// packages are listed, from its holder back up the supply chain. The receiver
+// accepts it, takes over the goods and then restocks or destroys them.
+// Site is the GLN of the site the goods leave from and ReceiverSite the one
+// they arrive at, both are optional.
+type ReturnRequest struct {
+	Id           string    `json:"id"`
+	CartonId     string    `json:"cartonId"`
+	WholeCarton  bool      `json:"wholeCarton"`
+	PackageIds   []string  `json:"packageIds"`
+	Requester    string    `json:"requester"`
+	Receiver     string    `json:"receiver"`
+	Reason       string    `json:"reason"`
+	Note         string    `json:"note,omitempty"`
+	Site         string    `json:"site,omitempty"`
+	ReceiverSite string    `json:"receiverSite,omitempty"`
+	Status       string    `json:"status"`
+	Created      time.Time `json:"created"`
+	Accepted     time.Time `json:"accepted"`
+	AcceptTxId   string    `json:"acceptTxId,omitempty"`
+	Closed       time.Time `json:"closed"`
+}
+
+// ReturnRef points to a return, Site is the GLN of the site the receiver accepts it at
+type ReturnRef struct {
+	ReturnId    string `json:"returnId"`
+	Disposition string `json:"disposition,omitempty"`
+	Site        string `json:"site,omitempty"`
+}
+
+const IndexReturn = "cn~return"
+
+// (cartonId, returnId) -> every return of a carton, for the history
+const IndexCartonReturn = "cn~cartonreturn"
+
+// cartonId -> id of the open return, locks the carton against transfers and other returns
+const IndexReturnLock = "cn~returnlock"
+
+// (requester|receiver, returnId) -> open returns of a participant
+const IndexReturnParty = "cn~returnparty"
+
+// reasons for a return
+const ReturnDamaged = "damaged"
+const ReturnExcess = "excess"
+const ReturnNearExpiry = "near-expiry"
+const ReturnWrongDelivery = "wrong-delivery"
+
+var ReturnReasons = []string{ReturnDamaged, ReturnExcess, ReturnNearExpiry, ReturnWrongDelivery}
+
+// status of a return, restocked and destroyed are the dispositions that close an accepted return
+const ReturnRequested = "requested"
+const ReturnAccepted = "accepted"
+const ReturnRejected = "rejected"
+const ReturnRestocked = "restocked"
+const ReturnDestroyed = "destroyed"
+
+// roles goods may be returned to
+var ReturnReceivers = []string{RoleProducer, RoleReseller}
+
+func (t *CounterfeitCC) getReturn(stub shim.ChaincodeStubInterface, returnId string) (ReturnRequest, error) {
+	key, _ := stub.CreateCompositeKey(IndexReturn, []string{returnId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return ReturnRequest{}, errors.New("Error getting return: " + err.Error())
+	} else if data == nil {
+		return ReturnRequest{}, errors.New("No return for " + returnId)
+	}
+
+	request := ReturnRequest{}
+	err = json.Unmarshal(data, &request)
+	if err != nil {
+		return ReturnRequest{}, errors.New("Error parsing return json: " + err.Error())
+	}
+
+	return request, nil
+}
+
+// isOpen says whether the return still holds the carton lock
+func (r ReturnRequest) isOpen() bool {
+	return r.Status == ReturnRequested || r.Status == ReturnAccepted
+}
+
+// putReturn stores the return and keeps the carton lock and the participant
+// indexes in step with its status: they only exist while the return is open
+func (t *CounterfeitCC) putReturn(stub shim.ChaincodeStubInterface, request ReturnRequest) error {
+	key, _ := stub.CreateCompositeKey(IndexReturn, []string{request.Id})
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return errors.New("Error marshaling return: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing return: " + err.Error())
+	}
+
+	cartonKey, _ := stub.CreateCompositeKey(IndexCartonReturn, []string{request.CartonId, request.Id})
+	err = stub.PutState(cartonKey, indexValue)
+	if err != nil {
+		return errors.New("Error indexing return: " + err.Error())
+	}
+
+	lockKey, _ := stub.CreateCompositeKey(IndexReturnLock, []string{request.CartonId})
+	requesterKey, _ := stub.CreateCompositeKey(IndexReturnParty, []string{request.Requester, request.Id})
+	receiverKey, _ := stub.CreateCompositeKey(IndexReturnParty, []string{request.Receiver, request.Id})
+
+	if request.isOpen() {
+		err = stub.PutState(lockKey, []byte(request.Id))
+		if err == nil {
+			err = stub.PutState(requesterKey, indexValue)
+		}
+		if err == nil {
+			err = stub.PutState(receiverKey, indexValue)
+		}
+	} else {
+		err = stub.DelState(lockKey)
+		if err == nil {
+			err = stub.DelState(requesterKey)
+		}
+		if err == nil {
+			err = stub.DelState(receiverKey)
+		}
+	}
+
+	if err != nil {
+		return errors.New("Error indexing return: " + err.Error())
+	}
+
+	return nil
+}
+
+// checkNoOpenReturn fails while a return holds the carton
+func (t *CounterfeitCC) checkNoOpenReturn(stub shim.ChaincodeStubInterface, cartonId string) error {
+	lockKey, _ := stub.CreateCompositeKey(IndexReturnLock, []string{cartonId})
+	data, err := stub.GetState(lockKey)
+	if err != nil {
+		return errors.New("Error getting return lock: " + err.Error())
+	} else if data != nil {
+		return errors.New("Carton " + cartonId + " is locked by return " + string(data))
+	}
+
+	return nil
+}
+
+// returnedPackages loads the packages the return covers
+func (t *CounterfeitCC) returnedPackages(stub shim.ChaincodeStubInterface, request ReturnRequest) ([]Package, error) {
+	var result []Package
+	for _, packageId := range request.PackageIds {
+		pckg, err := t.getPackage(stub, request.CartonId, packageId)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, pckg)
+	}
+
+	return result, nil
+}
+
+// checkReturnReceiver makes sure the receiver can take goods back and once
+// held the carton or produced it. Single packages may also go back to
+// somebody who held each of them on their own.
+func (t *CounterfeitCC) checkReturnReceiver(stub shim.ChaincodeStubInterface, carton Carton, packageIds []string, requester string, receiverName string) error {
+	if receiverName == requester {
+		return errors.New("Can't return goods to yourself")
+	}
+
+	receiver, err := t.findUser(stub, receiverName)
+	if err != nil {
+		return errors.New("Receiver '" + receiverName + "' is not registered")
+	} else if receiver.Status != UserApproved {
+		return errors.New("Receiver '" + receiverName + "' is " + receiver.Status)
+	} else if !contains(ReturnReceivers, receiver.Role) {
+		return errors.New("Goods can't be returned to a " + receiver.Role)
+	}
+
+	if carton.Producer == receiverName {
+		return nil
+	}
+
+	history, err := t.getCartonHistory(stub, carton.Id)
+	if err != nil {
+		return err
+	}
+
+	if heldBy(history, receiverName) {
+		return nil
+	} else if len(packageIds) == 0 {
+		return errors.New("Carton " + carton.Id + " never belonged to " + receiverName)
+	}
+
+	for _, packageId := range packageIds {
+		history, err := t.getPackageOwnHistory(stub, carton.Id, packageId)
+		if err != nil {
+			return err
+		}
+
+		if !heldBy(history, receiverName) {
+			return errors.New("Package " + carton.Id + ":" + packageId + " never belonged to " + receiverName)
+		}
+	}
+
+	return nil
+}
+
+// heldBy tells whether the owner appears in the history
+func heldBy(history []HistoryEntry, owner string) bool {
+	for _, entry := range history {
+		if entry.Owner == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestReturn is called by the holder of the goods. They go to returned right
+// away, so they can't be sold or handed on while the return is open.
+func (t *CounterfeitCC) requestReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	request := ReturnRequest{}
+	err = json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Error parsing return request json")
+	}
+
+	if !contains(ReturnReasons, request.Reason) {
+		return shim.Error("Unknown return reason '" + request.Reason + "'")
+	}
+
+	carton, err := t.getCarton(stub, request.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if carton.Parent != "" {
+		return shim.Error("Carton " + carton.Id + " is packed in container " + carton.Parent)
+	}
+
+	err = t.checkReturnReceiver(stub, carton, request.PackageIds, user.Name, request.Receiver)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkNoOpenReturn(stub, carton.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkSite(stub, request.Site, user.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a whole carton takes every package that follows it
+	request.WholeCarton = len(request.PackageIds) == 0
+	lockedIds := request.PackageIds
+	if request.WholeCarton {
+		if carton.Owner != user.Name {
+			return shim.Error("Carton doesn't belong to you!")
+		}
+
+		packages, err := t.getCartonPackages(stub, carton.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		request.PackageIds = []string{}
+		lockedIds = []string{}
+		for _, pckg := range packages {
+			if pckg.Owner == "" {
+				request.PackageIds = append(request.PackageIds, pckg.Id)
+			}
+			if packageOwner(carton, pckg) == user.Name {
+				lockedIds = append(lockedIds, pckg.Id)
+			}
+		}
+	}
+
+	// goods on offer can't go back at the same time, neither can a carton
+	// with packages of its holder on offer
+	lockKeys := []string{transferLockKey(stub, carton.Id, "")}
+	if len(lockedIds) > 0 {
+		lockKeys = append(lockKeys, transferLockKeys(stub, carton.Id, "", lockedIds)...)
+	}
+
+	for _, lockKey := range lockKeys {
+		pending, err := t.pendingTransfer(stub, lockKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if pending != nil {
+			return shim.Error("Goods are locked by transfer offer " + pending.Id)
+		}
+	}
+
+	packages, err := t.returnedPackages(stub, request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	seen := map[string]bool{}
+	for _, pckg := range packages {
+		if seen[pckg.Id] {
+			return shim.Error("Package " + pckg.Id + " is listed twice")
+		}
+		seen[pckg.Id] = true
+
+		if packageOwner(carton, pckg) != user.Name {
+			return shim.Error("Package " + carton.Id + ":" + pckg.Id + " doesn't belong to you")
+		}
+
+		// sold packages can't travel back with the carton
+		if pckg.State != PackageInDistribution {
+			return shim.Error("Package " + carton.Id + ":" + pckg.Id + " is " + pckg.State + ", return single packages instead")
+		}
+
+		_, err = t.transitionPackage(stub, carton.Id, pckg, PackageReturned)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id, err := newIdGenerator(stub).nextFree(IndexReturn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request = ReturnRequest{
+		Id:          id,
+		CartonId:    carton.Id,
+		WholeCarton: request.WholeCarton,
+		PackageIds:  request.PackageIds,
+		Requester:   user.Name,
+		Receiver:    request.Receiver,
+		Reason:      request.Reason,
+		Note:        request.Note,
+		Site:        request.Site,
+		Status:      ReturnRequested,
+		Created:     now,
+	}
+
+	return t.returnSuccess(stub, request)
+}
+
+// openReturn parses a ReturnRef argument and returns the return it points to
+// if the caller is its receiver and it has the given status
+func (t *CounterfeitCC) openReturn(stub shim.ChaincodeStubInterface, args []string, status string) (ReturnRequest, ReturnRef, error) {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return ReturnRequest{}, ReturnRef{}, err
+	}
+
+	if len(args) != 1 {
+		return ReturnRequest{}, ReturnRef{}, errors.New("expected 1 argument")
+	}
+
+	ref := ReturnRef{}
+	err = json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return ReturnRequest{}, ReturnRef{}, errors.New("Error parsing return request json")
+	}
+
+	request, err := t.getReturn(stub, ref.ReturnId)
+	if err != nil {
+		return ReturnRequest{}, ReturnRef{}, err
+	}
+
+	if request.Receiver != user.Name {
+		return ReturnRequest{}, ReturnRef{}, errors.New("Return " + request.Id + " is not addressed to you")
+	}
+
+	if request.Status != status {
+		return ReturnRequest{}, ReturnRef{}, errors.New("Return " + request.Id + " is " + request.Status)
+	}
+
+	return request, ref, nil
+}
+
+// acceptReturn is called by the receiver and hands the goods over to it
+func (t *CounterfeitCC) acceptReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	request, ref, err := t.openReturn(stub, args, ReturnRequested)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	carton, err := t.getCarton(stub, request.CartonId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.checkSite(stub, ref.Site, request.Receiver)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	request.ReceiverSite = ref.Site
+
+	if request.WholeCarton {
+		err = t.updateCartonOwner(stub, carton.Id, request.Receiver)
+	} else {
+		var packages []Package
+		packages, err = t.returnedPackages(stub, request)
+		for i := 0; err == nil && i < len(packages); i++ {
+			oldOwner := packages[i].Owner
+			packages[i].Owner = request.Receiver
+			if request.Receiver == carton.Owner {
+				packages[i].Owner = ""
+			}
+
+			err = t.indexPackageOwner(stub, carton.Id, packages[i].Id, oldOwner, packages[i].Owner)
+			if err == nil {
+				err = t.putPackage(stub, carton.Id, packages[i])
+			}
+		}
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request.Status = ReturnAccepted
+	request.Accepted = now
+	request.AcceptTxId = stub.GetTxID()
+
+	// the packages of a whole carton travel with it
+	var packageIds []string
+	if !request.WholeCarton {
+		packageIds = request.PackageIds
+	}
+
+	err = t.putHandover(stub, []string{carton.Id}, packageIds, request.Created, request.Requester, request.Site, request.Receiver, request.ReceiverSite)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.returnSuccess(stub, request)
+}
+
+// rejectReturn is called by the receiver, the goods stay with the requester
+func (t *CounterfeitCC) rejectReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	request, _, err := t.openReturn(stub, args, ReturnRequested)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.disposeReturn(stub, request, PackageInDistribution)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.closeReturn(stub, request, ReturnRejected)
+}
+
+// completeReturn is called by the receiver of an accepted return and puts the
+// goods back into distribution or destroys them
+func (t *CounterfeitCC) completeReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	request, ref, err := t.openReturn(stub, args, ReturnAccepted)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	switch ref.Disposition {
+	case ReturnRestocked:
+		err = t.disposeReturn(stub, request, PackageInDistribution)
+	case ReturnDestroyed:
+		err = t.disposeReturn(stub, request, PackageDestroyed)
+	default:
+		return shim.Error("Disposition must be " + ReturnRestocked + " or " + ReturnDestroyed)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.closeReturn(stub, request, ref.Disposition)
+}
+
+// disposeReturn moves the packages of the return that are still returned on to
+// the given state. Packages recalled in the meantime are left alone.
+func (t *CounterfeitCC) disposeReturn(stub shim.ChaincodeStubInterface, request ReturnRequest, to string) error {
+	packages, err := t.returnedPackages(stub, request)
+	if err != nil {
+		return err
+	}
+
+	for _, pckg := range packages {
+		if pckg.State != PackageReturned {
+			continue
+		}
+
+		_, err = t.transitionPackage(stub, request.CartonId, pckg, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) closeReturn(stub shim.ChaincodeStubInterface, request ReturnRequest, status string) pb.Response {
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	request.Status = status
+	request.Closed = now
+
+	return t.returnSuccess(stub, request)
+}
+
+func (t *CounterfeitCC) returnSuccess(stub shim.ChaincodeStubInterface, request ReturnRequest) pb.Response {
+	err := t.putReturn(stub, request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return shim.Error("Error generating return response")
+	}
+
+	return shim.Success(data)
+}
+
+func (t *CounterfeitCC) getReturnRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := ReturnRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing return request json")
+	}
+
+	request, err := t.getReturn(stub, ref.ReturnId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return shim.Error("Error generating return response")
+	}
+
+	return shim.Success(data)
+}
+
+// listReturns returns the open returns the caller is requester or receiver of
+func (t *CounterfeitCC) listReturns(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(IndexReturnParty, []string{caller})
+	if err != nil {
+		return shim.Error("Error listing returns: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []ReturnRequest = []ReturnRequest{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return shim.Error("Error listing returns: " + err.Error())
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) != 2 {
+			return shim.Error("Error parsing return key")
+		}
+
+		request, err := t.getReturn(stub, attributes[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		result = append(result, request)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating return list response")
+	}
+
+	return shim.Success(data)
+}
+
+// getCartonReturns returns every return of the carton, oldest first
+func (t *CounterfeitCC) getCartonReturns(stub shim.ChaincodeStubInterface, cartonId string) ([]ReturnRequest, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexCartonReturn, []string{cartonId})
+	if err != nil {
+		return nil, errors.New("Error listing returns: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []ReturnRequest = []ReturnRequest{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error listing returns: " + err.Error())
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) != 2 {
+			return nil, errors.New("Error parsing return key")
+		}
+
+		request, err := t.getReturn(stub, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, request)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+
+	return result, nil
+}
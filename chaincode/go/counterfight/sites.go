@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type Address struct {
+	Street     string `json:"street"`
+	City       string `json:"city"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+// GeoLocation is a WGS 84 position in decimal degrees
+type GeoLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Site is a place where a participant handles goods, identified by its GS1 Global Location Number
+type Site struct {
+	Gln     string      `json:"gln"`
+	Name    string      `json:"name"`
+	Owner   string      `json:"owner"`
+	Address Address     `json:"address"`
+	Geo     GeoLocation `json:"geo"`
+	Created time.Time   `json:"created"`
+}
+
+type SiteRef struct {
+	Gln string `json:"gln"`
+}
+
+// Stop is a point of the custody trail of a carton: where it was created,
+// shipped from, received at or where a package was sold. PackageIds is set
+// if the stop only concerns some packages of the carton. Gln is empty for
+// stops recorded without a site.
+type Stop struct {
+	Time       time.Time `json:"time"`
+	TxId       string    `json:"txId"`
+	Event      string    `json:"event"`
+	Party      string    `json:"party"`
+	Gln        string    `json:"gln,omitempty"`
+	PackageIds []string  `json:"packageIds,omitempty"`
+}
+
+// RouteStop is a stop with the details of its site
+type RouteStop struct {
+	Stop
+	Site *Site `json:"site,omitempty"`
+}
+
+type RouteResponse struct {
+	CartonId  string      `json:"cartonId"`
+	PackageId string      `json:"packageId"`
+	Stops     []RouteStop `json:"stops"`
+}
+
+// gln -> Site
+const IndexSite = "cn~site"
+
+// (owner, gln) -> the sites of a participant
+const IndexOwnerSite = "cn~ownersite"
+
+// (cartonId, txId, n) -> Stop, the n-th stop of the carton in the transaction
+const IndexStop = "cn~stop"
+
+// events of a stop
+const StopCreated = "created"
+const StopShipped = "shipped"
+const StopReceived = "received"
+const StopSold = "sold"
+
+// ISO 3166-1 alpha-2 country code
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// validateGln accepts a 13 digit GLN with a correct check digit
+func validateGln(gln string) error {
+	if len(gln) != 13 {
+		return errors.New("GLN '" + gln + "' must have 13 digits")
+	}
+
+	for i := 0; i < len(gln); i++ {
+		if gln[i] < '0' || gln[i] > '9' {
+			return errors.New("GLN '" + gln + "' must only contain digits")
+		}
+	}
+
+	if gs1CheckDigit(gln[:12]) != gln[12] {
+		return errors.New("GLN '" + gln + "' has a wrong check digit")
+	}
+
+	return nil
+}
+
+func validateSite(site Site) error {
+	err := validateGln(site.Gln)
+	if err != nil {
+		return err
+	}
+
+	if site.Name == "" {
+		return errors.New("A site needs a name")
+	}
+
+	if !countryPattern.MatchString(site.Address.Country) {
+		return errors.New("Country '" + site.Address.Country + "' must be an ISO 3166 alpha-2 code")
+	}
+
+	return validateGeo(site.Geo)
+}
+
+func validateGeo(geo GeoLocation) error {
+	if geo.Latitude < -90 || geo.Latitude > 90 {
+		return errors.New("The latitude must be between -90 and 90 degrees")
+	} else if geo.Longitude < -180 || geo.Longitude > 180 {
+		return errors.New("The longitude must be between -180 and 180 degrees")
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) getSite(stub shim.ChaincodeStubInterface, gln string) (Site, error) {
+	key, _ := stub.CreateCompositeKey(IndexSite, []string{gln})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return Site{}, errors.New("Error getting site: " + err.Error())
+	} else if data == nil {
+		return Site{}, errors.New("No site for GLN " + gln)
+	}
+
+	site := Site{}
+	err = json.Unmarshal(data, &site)
+	if err != nil {
+		return Site{}, errors.New("Error parsing site json: " + err.Error())
+	}
+
+	return site, nil
+}
+
+// checkSite makes sure the party acts at a site of its own. Goods may still
+// move without a site, so an empty GLN passes.
+func (t *CounterfeitCC) checkSite(stub shim.ChaincodeStubInterface, gln string, party string) error {
+	if gln == "" {
+		return nil
+	}
+
+	site, err := t.getSite(stub, gln)
+	if err != nil {
+		return err
+	} else if site.Owner != party {
+		return errors.New("Site " + gln + " doesn't belong to " + party)
+	}
+
+	return nil
+}
+
+// putStop records the n-th stop of the carton in this transaction
+func (t *CounterfeitCC) putStop(stub shim.ChaincodeStubInterface, cartonId string, n int, stop Stop) error {
+	key, _ := stub.CreateCompositeKey(IndexStop, []string{cartonId, stop.TxId, strconv.Itoa(n)})
+
+	data, err := json.Marshal(stop)
+	if err != nil {
+		return errors.New("Error marshaling stop: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing stop: " + err.Error())
+	}
+
+	return nil
+}
+
+// recordStop records a stop of the carton at the time of the transaction
+func (t *CounterfeitCC) recordStop(stub shim.ChaincodeStubInterface, cartonId string, event string, party string, gln string, packageIds []string) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	return t.putStop(stub, cartonId, 0, Stop{
+		Time:       now,
+		TxId:       stub.GetTxID(),
+		Event:      event,
+		Party:      party,
+		Gln:        gln,
+		PackageIds: packageIds,
+	})
+}
+
+// recordHandover records the goods of an accepted offer as shipped from the
+// seller's site when the offer was made and received at the buyer's site now
+func (t *CounterfeitCC) recordHandover(stub shim.ChaincodeStubInterface, offer TransferOffer) error {
+	cartonIds := []string{offer.CartonId}
+	if offer.ContainerId != "" {
+		var err error
+		cartonIds, _, err = t.collectContents(stub, offer.ContainerId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.putHandover(stub, cartonIds, offer.PackageIds, offer.Created, offer.Seller, offer.SellerSite, offer.Buyer, offer.BuyerSite)
+}
+
+// putHandover records the cartons, or only the packages if any are given, as
+// shipped by the sender at the time given and received by the receiver now
+func (t *CounterfeitCC) putHandover(stub shim.ChaincodeStubInterface, cartonIds []string, packageIds []string, shipped time.Time, sender string, senderSite string, receiver string, receiverSite string) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, cartonId := range cartonIds {
+		err = t.putStop(stub, cartonId, 0, Stop{
+			Time:       shipped,
+			TxId:       stub.GetTxID(),
+			Event:      StopShipped,
+			Party:      sender,
+			Gln:        senderSite,
+			PackageIds: packageIds,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = t.putStop(stub, cartonId, 1, Stop{
+			Time:       now,
+			TxId:       stub.GetTxID(),
+			Event:      StopReceived,
+			Party:      receiver,
+			Gln:        receiverSite,
+			PackageIds: packageIds,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getCartonStops returns all stops of the carton, oldest first
+func (t *CounterfeitCC) getCartonStops(stub shim.ChaincodeStubInterface, cartonId string) ([]Stop, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexStop, []string{cartonId})
+	if err != nil {
+		return nil, errors.New("Error getting stops: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []Stop = []Stop{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading stops: " + err.Error())
+		}
+
+		stop := Stop{}
+		err = json.Unmarshal(kv.Value, &stop)
+		if err != nil {
+			return nil, errors.New("Error parsing stop json: " + err.Error())
+		}
+
+		result = append(result, stop)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+
+	return result, nil
+}
+
+// getPackageStops returns the stops of the carton that concern the package,
+// oldest first. A package received by somebody else than the carton holder
+// has an owner of its own, the carton's stops skip it until it is received
+// back by the carton holder.
+func (t *CounterfeitCC) getPackageStops(stub shim.ChaincodeStubInterface, cartonId string, packageId string) ([]Stop, error) {
+	result, err := t.getCartonStops(stub, cartonId)
+	if err != nil {
+		return nil, err
+	}
+
+	var stops []Stop = []Stop{}
+	holder := ""
+	detached := false
+	for _, stop := range result {
+		if len(stop.PackageIds) != 0 && !contains(stop.PackageIds, packageId) {
+			continue
+		}
+
+		if len(stop.PackageIds) == 0 {
+			if stop.Event == StopCreated || stop.Event == StopReceived {
+				holder = stop.Party
+			}
+			if detached {
+				continue
+			}
+		} else if stop.Event == StopReceived {
+			detached = stop.Party != holder
+		}
+
+		stops = append(stops, stop)
+	}
+
+	return stops, nil
+}
+
+// registerSite adds a site of the caller
+func (t *CounterfeitCC) registerSite(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	site := Site{}
+	err = json.Unmarshal([]byte(args[0]), &site)
+	if err != nil {
+		return shim.Error("Error parsing site json")
+	}
+
+	err = validateSite(site)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexSite, []string{site.Gln})
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error("Error getting site: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("Site " + site.Gln + " is already registered")
+	}
+
+	site.Owner = user.Name
+	site.Created, err = txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(site)
+	if err != nil {
+		return shim.Error("Error marshaling site: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return shim.Error("Error storing site: " + err.Error())
+	}
+
+	ownerKey, _ := stub.CreateCompositeKey(IndexOwnerSite, []string{site.Owner, site.Gln})
+	err = stub.PutState(ownerKey, indexValue)
+	if err != nil {
+		return shim.Error("Error indexing site: " + err.Error())
+	}
+
+	return shim.Success(data)
+}
+
+func (t *CounterfeitCC) getSiteDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := SiteRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing getSite request json")
+	}
+
+	site, err := t.getSite(stub, ref.Gln)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(site)
+	if err != nil {
+		return shim.Error("Error generating site response")
+	}
+
+	return shim.Success(data)
+}
+
+// getRoute returns the places a package went through in order, with the
+// address and position of every site. Goods created before sites were
+// recorded start their route at their first transfer since.
+func (t *CounterfeitCC) getRoute(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := PackageRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing getRoute request json")
+	}
+
+	ref, err = t.resolvePackageRef(stub, ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	_, err = t.getPackage(stub, ref.CartonId, ref.PackageId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stops, err := t.getPackageStops(stub, ref.CartonId, ref.PackageId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sites := map[string]*Site{}
+	response := RouteResponse{CartonId: ref.CartonId, PackageId: ref.PackageId, Stops: []RouteStop{}}
+	for _, stop := range stops {
+		routeStop := RouteStop{Stop: stop}
+		if stop.Gln != "" {
+			if _, ok := sites[stop.Gln]; !ok {
+				site, err := t.getSite(stub, stop.Gln)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				sites[stop.Gln] = &site
+			}
+			routeStop.Site = sites[stop.Gln]
+		}
+
+		response.Stops = append(response.Stops, routeStop)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Error generating route response")
+	}
+
+	return shim.Success(data)
+}
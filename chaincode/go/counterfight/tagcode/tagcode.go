@@ -0,0 +1,248 @@
+// Package tagcode defines what is printed on a package: a compact, URL-safe
+// code carrying the carton and package id, optionally the GS1 data of the
+// package and the producer's signature of its tag.
+//
+// A code is the unpadded base64url encoding of
+//
+//	version | flags | cartonId | packageId | [gtin] | [serial] | [lot] | [expiry] | [signature] | crc32
+//
+// where strings and the signature are prefixed by their length as uvarint,
+// the GTIN and the YYMMDD expiry date are uvarints of their digits, flags
+// says which optional fields follow and crc32 is the big endian IEEE CRC-32
+// of everything before it.
+package tagcode
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Version is the format version written by Encode
+const Version = 1
+
+// flags of the optional fields
+const (
+	flagGtin = 1 << iota
+	flagSerial
+	flagLot
+	flagExpiry
+	flagSignature
+)
+
+const checksumSize = 4
+
+var ErrEncoding = errors.New("The code isn't base64url")
+var ErrChecksum = errors.New("The code checksum doesn't match, it was misread or altered")
+var ErrVersion = errors.New("The code has an unknown version")
+var ErrMalformed = errors.New("The code is malformed")
+
+// Tag is the content of a code. Gtin is decoded as GTIN-14, Expiry is the
+// YYMMDD date of GS1 AI 17 and Signature the raw ASN.1 ECDSA signature.
+type Tag struct {
+	CartonId  string
+	PackageId string
+	Gtin      string
+	Serial    string
+	Lot       string
+	Expiry    string
+	Signature []byte
+}
+
+// HasGs1 tells whether the tag carries GS1 data
+func (tag Tag) HasGs1() bool {
+	return tag.Gtin != "" || tag.Serial != "" || tag.Lot != "" || tag.Expiry != ""
+}
+
+func isDigits(value string) bool {
+	return value != "" && strings.Trim(value, "0123456789") == ""
+}
+
+func validate(tag Tag) error {
+	if tag.CartonId == "" || tag.PackageId == "" {
+		return errors.New("A code needs a carton and package id")
+	}
+
+	if tag.Gtin != "" && (!isDigits(tag.Gtin) || len(tag.Gtin) > 14) {
+		return errors.New("GTIN '" + tag.Gtin + "' must have at most 14 digits")
+	}
+
+	if tag.Expiry != "" && (!isDigits(tag.Expiry) || len(tag.Expiry) != 6) {
+		return errors.New("Expiry date '" + tag.Expiry + "' must be YYMMDD")
+	}
+
+	for _, value := range []string{tag.CartonId, tag.PackageId, tag.Serial, tag.Lot} {
+		if !utf8.ValidString(value) {
+			return errors.New("The ids, serial and lot must be UTF-8")
+		}
+	}
+
+	return nil
+}
+
+// Encode returns the code of a tag
+func Encode(tag Tag) (string, error) {
+	err := validate(tag)
+	if err != nil {
+		return "", err
+	}
+
+	var flags byte
+	if tag.Gtin != "" {
+		flags |= flagGtin
+	}
+	if tag.Serial != "" {
+		flags |= flagSerial
+	}
+	if tag.Lot != "" {
+		flags |= flagLot
+	}
+	if tag.Expiry != "" {
+		flags |= flagExpiry
+	}
+	if len(tag.Signature) > 0 {
+		flags |= flagSignature
+	}
+
+	data := []byte{Version, flags}
+	data = appendBytes(data, []byte(tag.CartonId))
+	data = appendBytes(data, []byte(tag.PackageId))
+	if flags&flagGtin != 0 {
+		data = appendNumber(data, tag.Gtin)
+	}
+	if flags&flagSerial != 0 {
+		data = appendBytes(data, []byte(tag.Serial))
+	}
+	if flags&flagLot != 0 {
+		data = appendBytes(data, []byte(tag.Lot))
+	}
+	if flags&flagExpiry != 0 {
+		data = appendNumber(data, tag.Expiry)
+	}
+	if flags&flagSignature != 0 {
+		data = appendBytes(data, tag.Signature)
+	}
+
+	checksum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(data))
+	data = append(data, checksum...)
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(data, buf[:binary.PutUvarint(buf, value)]...)
+}
+
+func appendBytes(data []byte, value []byte) []byte {
+	return append(appendUvarint(data, uint64(len(value))), value...)
+}
+
+// appendNumber writes a string of digits, validate made sure it fits
+func appendNumber(data []byte, digits string) []byte {
+	value, _ := strconv.ParseUint(digits, 10, 64)
+	return appendUvarint(data, value)
+}
+
+// Decode reads a code and checks its checksum
+func Decode(code string) (Tag, error) {
+	data, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return Tag{}, ErrEncoding
+	} else if len(data) < 2+checksumSize {
+		return Tag{}, ErrMalformed
+	}
+
+	body := data[:len(data)-checksumSize]
+	if binary.BigEndian.Uint32(data[len(body):]) != crc32.ChecksumIEEE(body) {
+		return Tag{}, ErrChecksum
+	} else if body[0] != Version {
+		return Tag{}, ErrVersion
+	}
+
+	r := reader{data: body[2:]}
+	flags := body[1]
+	tag := Tag{
+		CartonId:  string(r.bytes()),
+		PackageId: string(r.bytes()),
+	}
+	if flags&flagGtin != 0 {
+		tag.Gtin = r.number(14)
+	}
+	if flags&flagSerial != 0 {
+		tag.Serial = string(r.bytes())
+	}
+	if flags&flagLot != 0 {
+		tag.Lot = string(r.bytes())
+	}
+	if flags&flagExpiry != 0 {
+		tag.Expiry = r.number(6)
+	}
+	if flags&flagSignature != 0 {
+		tag.Signature = r.bytes()
+	}
+
+	if r.failed || len(r.data) != 0 || flags >= flagSignature<<1 {
+		return Tag{}, ErrMalformed
+	}
+
+	err = validate(tag)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	return tag, nil
+}
+
+// Validate tells whether a code can be decoded
+func Validate(code string) error {
+	_, err := Decode(code)
+	return err
+}
+
+// reader consumes the fields of a code, failed is set once a field overruns it
+type reader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *reader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.failed = true
+		r.data = nil
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *reader) bytes() []byte {
+	length := r.uvarint()
+	if length > uint64(len(r.data)) {
+		r.failed = true
+		r.data = nil
+		return nil
+	}
+
+	value := r.data[:length]
+	r.data = r.data[length:]
+	return value
+}
+
+// number reads a string of digits, zero padded to width
+func (r *reader) number(width int) string {
+	digits := strconv.FormatUint(r.uvarint(), 10)
+	if len(digits) > width {
+		r.failed = true
+		return ""
+	}
+
+	return strings.Repeat("0", width-len(digits)) + digits
+}
@@ -0,0 +1,67 @@
+package tagcode
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tags := []Tag{
+		{CartonId: "1", PackageId: "2"},
+		{CartonId: "1", PackageId: "SN-1", Gtin: "04012345678901", Serial: "SN-1", Lot: "L-1", Expiry: "270100", Signature: []byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x02}},
+		{CartonId: "1", PackageId: "2", Gtin: "4012345678901"},
+	}
+
+	for _, tag := range tags {
+		code, err := Encode(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			t.Errorf("Code %s isn't URL-safe", code)
+		}
+
+		decoded, err := Decode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// GTINs come back as GTIN-14
+		if len(tag.Gtin) == 13 {
+			tag.Gtin = "0" + tag.Gtin
+		}
+		if !reflect.DeepEqual(decoded, tag) {
+			t.Errorf("Decoded %v, expected %v", decoded, tag)
+		}
+	}
+}
+
+func TestInvalidCodes(t *testing.T) {
+	if _, err := Encode(Tag{CartonId: "1"}); err == nil {
+		t.Error("A code needs a package id")
+	}
+
+	if _, err := Encode(Tag{CartonId: "1", PackageId: "2", Expiry: "2701"}); err == nil {
+		t.Error("An expiry date must be YYMMDD")
+	}
+
+	code, _ := Encode(Tag{CartonId: "1", PackageId: "2", Lot: "L-1"})
+	data, _ := base64.RawURLEncoding.DecodeString(code)
+
+	altered := append([]byte{}, data...)
+	altered[len(altered)-6] ^= 0x01
+	if err := Validate(base64.RawURLEncoding.EncodeToString(altered)); err != ErrChecksum {
+		t.Errorf("Expected a checksum error, got %v", err)
+	}
+
+	if err := Validate(code[:len(code)-2]); err == nil {
+		t.Error("A truncated code must not validate")
+	}
+
+	if err := Validate("not a code!"); err != ErrEncoding {
+		t.Errorf("Expected an encoding error, got %v", err)
+	}
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// TransferOffer hands a carton, some packages of a carton if PackageIds is
+// set, or a container with everything packed in it if ContainerId is set
+// from the seller to the buyer. SellerSite is the GLN of the site the goods
+// leave from and BuyerSite the one they arrive at, both are optional.
+// Quarantined lists the cartons of the goods that are quarantined after a
+// storage excursion, it is only set in responses.
+type TransferOffer struct {
+	Id          string    `json:"id"`
+	CartonId    string    `json:"cartonId,omitempty"`
+	PackageIds  []string  `json:"packageIds,omitempty"`
+	ContainerId string    `json:"containerId,omitempty"`
+	Seller      string    `json:"seller"`
+	Buyer       string    `json:"buyer"`
+	Status      string    `json:"status"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Closed      time.Time `json:"closed"`
+	SellerSite  string    `json:"sellerSite,omitempty"`
+	BuyerSite   string    `json:"buyerSite,omitempty"`
+	Quarantined []string  `json:"quarantined,omitempty"`
+}
+
+// TransferRef points to an offer, Site is the GLN of the buyer's site when accepting it
+type TransferRef struct {
+	TransferId string `json:"transferId"`
+	Site       string `json:"site,omitempty"`
+}
+
+const IndexTransfer = "cn~transfer"
+
+// cartonId -> id of the pending offer, locks the carton against other transfers
+const IndexTransferLock = "cn~transferlock"
+
+// containerId -> id of the pending offer, the same for containers
+const IndexContainerLock = "cn~containerlock"
+
+// (cartonId, packageId) -> id of the pending offer, the same for single packages
+const IndexPackageLock = "cn~packagelock"
+
+// (buyer|seller, transferId) -> pending offers of a participant
+const IndexTransferBuyer = "cn~transferbuyer"
+const IndexTransferSeller = "cn~transferseller"
+
+// status of a transfer offer
+const TransferPending = "pending"
+const TransferAccepted = "accepted"
+const TransferRejected = "rejected"
+const TransferCancelled = "cancelled"
+const TransferExpired = "expired"
+
+// how long an offer stays open if the seller doesn't say otherwise
+const DefaultTransferValidity = 72 * time.Hour
+
+// value of keys that only exist to be found by a partial composite key query
+var indexValue = []byte{0x00}
+
+func (t *CounterfeitCC) getTransfer(stub shim.ChaincodeStubInterface, transferId string) (TransferOffer, error) {
+	key, _ := stub.CreateCompositeKey(IndexTransfer, []string{transferId})
+	data, err := stub.GetState(key)
+	if err != nil {
+		return TransferOffer{}, errors.New("Error getting transfer offer: " + err.Error())
+	} else if data == nil {
+		return TransferOffer{}, errors.New("No transfer offer for " + transferId)
+	}
+
+	offer := TransferOffer{}
+	err = json.Unmarshal(data, &offer)
+	if err != nil {
+		return TransferOffer{}, errors.New("Error parsing transfer offer json: " + err.Error())
+	}
+
+	return offer, nil
+}
+
+// putTransfer stores the offer and keeps the carton lock and the participant
+// indexes in step with its status: they only exist while the offer is pending
+func (t *CounterfeitCC) putTransfer(stub shim.ChaincodeStubInterface, offer TransferOffer) error {
+	key, _ := stub.CreateCompositeKey(IndexTransfer, []string{offer.Id})
+
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return errors.New("Error marshaling transfer offer: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing transfer offer: " + err.Error())
+	}
+
+	buyerKey, _ := stub.CreateCompositeKey(IndexTransferBuyer, []string{offer.Buyer, offer.Id})
+	sellerKey, _ := stub.CreateCompositeKey(IndexTransferSeller, []string{offer.Seller, offer.Id})
+
+	for _, lockKey := range transferLockKeys(stub, offer.CartonId, offer.ContainerId, offer.PackageIds) {
+		if offer.Status == TransferPending {
+			err = stub.PutState(lockKey, []byte(offer.Id))
+		} else {
+			err = stub.DelState(lockKey)
+		}
+		if err != nil {
+			return errors.New("Error locking goods of transfer offer: " + err.Error())
+		}
+	}
+
+	if offer.Status == TransferPending {
+		err = stub.PutState(buyerKey, indexValue)
+		if err == nil {
+			err = stub.PutState(sellerKey, indexValue)
+		}
+	} else {
+		err = stub.DelState(buyerKey)
+		if err == nil {
+			err = stub.DelState(sellerKey)
+		}
+	}
+
+	if err != nil {
+		return errors.New("Error indexing transfer offer: " + err.Error())
+	}
+
+	return nil
+}
+
+// transferLockKey returns the key locking the container if one is given or else the carton
+func transferLockKey(stub shim.ChaincodeStubInterface, cartonId string, containerId string) string {
+	if containerId != "" {
+		key, _ := stub.CreateCompositeKey(IndexContainerLock, []string{containerId})
+		return key
+	}
+
+	key, _ := stub.CreateCompositeKey(IndexTransferLock, []string{cartonId})
+	return key
+}
+
+// transferLockKeys returns the keys an offer locks: the offered packages, or
+// else the container or the carton
+func transferLockKeys(stub shim.ChaincodeStubInterface, cartonId string, containerId string, packageIds []string) []string {
+	if len(packageIds) == 0 {
+		return []string{transferLockKey(stub, cartonId, containerId)}
+	}
+
+	var keys []string
+	for _, packageId := range packageIds {
+		key, _ := stub.CreateCompositeKey(IndexPackageLock, []string{cartonId, packageId})
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// pendingTransfer returns the open offer holding the lock or nil. An offer that
+// expired in the meantime is closed here, which releases the lock.
+func (t *CounterfeitCC) pendingTransfer(stub shim.ChaincodeStubInterface, lockKey string) (*TransferOffer, error) {
+	data, err := stub.GetState(lockKey)
+	if err != nil {
+		return nil, errors.New("Error getting transfer lock: " + err.Error())
+	} else if data == nil {
+		return nil, nil
+	}
+
+	offer, err := t.getTransfer(stub, string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if now.After(offer.Expires) {
+		offer.Status = TransferExpired
+		offer.Closed = now
+		return nil, t.putTransfer(stub, offer)
+	}
+
+	return &offer, nil
+}
+
+// pendingPackageTransfer returns an open offer the holder made for packages
+// of the carton or nil
+func (t *CounterfeitCC) pendingPackageTransfer(stub shim.ChaincodeStubInterface, cartonId string, holder string) (*TransferOffer, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexPackageLock, []string{cartonId})
+	if err != nil {
+		return nil, errors.New("Error getting package locks: " + err.Error())
+	}
+
+	var lockKeys []string
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, errors.New("Error reading package locks: " + err.Error())
+		}
+		lockKeys = append(lockKeys, kv.Key)
+	}
+	iter.Close()
+
+	// pendingTransfer may close expired offers, which deletes their locks
+	for _, lockKey := range lockKeys {
+		pending, err := t.pendingTransfer(stub, lockKey)
+		if err != nil {
+			return nil, err
+		} else if pending != nil && pending.Seller == holder {
+			return pending, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// checkTransferable makes sure the owner may hand on the carton or container:
+// it must not be packed in a container and none of the goods may be recalled,
+// expired, on their way back in a return or offered package by package
+func (t *CounterfeitCC) checkTransferable(stub shim.ChaincodeStubInterface, owner string, cartonId string, containerId string) error {
+	var cartonIds []string
+	if containerId != "" {
+		container, err := t.getContainer(stub, containerId)
+		if err != nil {
+			return err
+		}
+
+		if container.Owner != owner {
+			return errors.New("Container " + containerId + " doesn't belong to " + owner)
+		} else if container.Parent != "" {
+			return errors.New("Container " + containerId + " is packed in container " + container.Parent)
+		}
+
+		cartonIds, _, err = t.collectContents(stub, containerId)
+		if err != nil {
+			return err
+		}
+	} else {
+		carton, err := t.getCarton(stub, cartonId)
+		if err != nil {
+			return err
+		}
+
+		if carton.Owner != owner {
+			return errors.New("Carton " + cartonId + " doesn't belong to " + owner)
+		} else if carton.Parent != "" {
+			return errors.New("Carton " + cartonId + " is packed in container " + carton.Parent)
+		}
+
+		cartonIds = []string{cartonId}
+	}
+
+	for _, id := range cartonIds {
+		carton, err := t.getCarton(stub, id)
+		if err != nil {
+			return err
+		}
+
+		err = t.checkNotRecalled(stub, id)
+		if err != nil {
+			return err
+		}
+
+		err = t.checkNoOpenReturn(stub, id)
+		if err != nil {
+			return err
+		}
+
+		err = checkNotExpired(stub, carton)
+		if err != nil {
+			return err
+		}
+
+		pending, err := t.pendingPackageTransfer(stub, id, owner)
+		if err != nil {
+			return err
+		} else if pending != nil {
+			return errors.New("Packages of carton " + id + " are locked by transfer offer " + pending.Id)
+		}
+	}
+
+	return nil
+}
+
+// checkPackagesTransferable makes sure the owner holds each of the packages
+// and they are still in distribution, in an unpacked carton that is neither
+// recalled, expired nor part of an open return
+func (t *CounterfeitCC) checkPackagesTransferable(stub shim.ChaincodeStubInterface, owner string, cartonId string, packageIds []string) error {
+	carton, err := t.getCarton(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	if carton.Parent != "" {
+		return errors.New("Carton " + cartonId + " is packed in container " + carton.Parent)
+	}
+
+	err = t.checkNotRecalled(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	err = t.checkNoOpenReturn(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotExpired(stub, carton)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, packageId := range packageIds {
+		if seen[packageId] {
+			return errors.New("Package " + packageId + " is listed twice")
+		}
+		seen[packageId] = true
+
+		pckg, err := t.getPackage(stub, cartonId, packageId)
+		if err != nil {
+			return err
+		}
+
+		if packageOwner(carton, pckg) != owner {
+			return errors.New("Package " + cartonId + ":" + packageId + " doesn't belong to " + owner)
+		}
+
+		err = checkTransition(cartonId, pckg, PackageInDistribution)
+		if err != nil && pckg.State != PackageInDistribution {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkOffer makes sure the seller may offer the goods to the buyer
+func (t *CounterfeitCC) checkOffer(stub shim.ChaincodeStubInterface, seller User, ref CartonRef) error {
+	if (ref.CartonId == "") == (ref.ContainerId == "") {
+		return errors.New("Either cartonId or containerId is required")
+	}
+
+	var err error
+	if len(ref.PackageIds) > 0 {
+		if ref.ContainerId != "" {
+			return errors.New("packageIds need a cartonId")
+		}
+		err = t.checkPackagesTransferable(stub, seller.Name, ref.CartonId, ref.PackageIds)
+	} else {
+		err = t.checkTransferable(stub, seller.Name, ref.CartonId, ref.ContainerId)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = t.checkFlow(stub, seller, ref.Buyer)
+	if err != nil {
+		return err
+	}
+
+	err = t.checkSite(stub, ref.Site, seller.Name)
+	if err != nil {
+		return err
+	}
+
+	// packages can't be offered while the whole carton is
+	lockKeys := transferLockKeys(stub, ref.CartonId, ref.ContainerId, ref.PackageIds)
+	if len(ref.PackageIds) > 0 {
+		lockKeys = append(lockKeys, transferLockKey(stub, ref.CartonId, ""))
+	}
+
+	for _, lockKey := range lockKeys {
+		pending, err := t.pendingTransfer(stub, lockKey)
+		if err != nil {
+			return err
+		} else if pending != nil {
+			return errors.New("Goods are locked by transfer offer " + pending.Id)
+		}
+	}
+
+	if ref.ValidFor < 0 {
+		return errors.New("validFor must not be negative")
+	}
+
+	return nil
+}
+
+// offerTransfer opens an offer from the owner to the buyer and locks the goods
+func (t *CounterfeitCC) offerTransfer(stub shim.ChaincodeStubInterface, ids *idGenerator, seller User, ref CartonRef) (TransferOffer, error) {
+	err := t.checkOffer(stub, seller, ref)
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	validity := DefaultTransferValidity
+	if ref.ValidFor > 0 {
+		validity = time.Duration(ref.ValidFor) * time.Second
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	id, err := ids.nextFree(IndexTransfer)
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	offer := TransferOffer{
+		Id:          id,
+		CartonId:    ref.CartonId,
+		PackageIds:  ref.PackageIds,
+		ContainerId: ref.ContainerId,
+		Seller:      seller.Name,
+		Buyer:       ref.Buyer,
+		Status:      TransferPending,
+		Created:     now,
+		Expires:     now.Add(validity),
+		SellerSite:  ref.Site,
+	}
+
+	err = t.putTransfer(stub, offer)
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	err = emitEvent(stub, transferEvent(EventTransferOffered, seller.Name, offer))
+	if err != nil {
+		return TransferOffer{}, err
+	}
+
+	return t.withColdChain(stub, offer)
+}
+
+// movePackages hands single packages to the new owner, the rest of the carton stays where it is
+func (t *CounterfeitCC) movePackages(stub shim.ChaincodeStubInterface, cartonId string, packageIds []string, newOwner string) error {
+	carton, err := t.getCarton(stub, cartonId)
+	if err != nil {
+		return err
+	}
+
+	for _, packageId := range packageIds {
+		pckg, err := t.getPackage(stub, cartonId, packageId)
+		if err != nil {
+			return err
+		}
+
+		// a package going back to the carton owner follows the carton again
+		oldOwner := pckg.Owner
+		pckg.Owner = newOwner
+		if newOwner == carton.Owner {
+			pckg.Owner = ""
+		}
+
+		err = t.indexPackageOwner(stub, cartonId, packageId, oldOwner, pckg.Owner)
+		if err != nil {
+			return err
+		}
+
+		if pckg.State != PackageInDistribution {
+			_, err = t.transitionPackage(stub, cartonId, pckg, PackageInDistribution)
+		} else {
+			err = t.putPackage(stub, cartonId, pckg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transferPackages offers some packages of a carton to the buyer
+func (t *CounterfeitCC) transferPackages(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := CartonRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing transferPackages request json")
+	}
+
+	if len(ref.PackageIds) == 0 {
+		return shim.Error("packageIds are required")
+	}
+
+	return t.sellCarton(stub, args)
+}
+
+// openTransfer parses a TransferRef argument and returns the pending offer it points to
+func (t *CounterfeitCC) openTransfer(stub shim.ChaincodeStubInterface, args []string) (TransferOffer, TransferRef, error) {
+	if len(args) != 1 {
+		return TransferOffer{}, TransferRef{}, errors.New("expected 1 argument")
+	}
+
+	ref := TransferRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return TransferOffer{}, TransferRef{}, errors.New("Error parsing transfer request json")
+	}
+
+	offer, err := t.getTransfer(stub, ref.TransferId)
+	if err != nil {
+		return TransferOffer{}, TransferRef{}, err
+	}
+
+	if offer.Status != TransferPending {
+		return TransferOffer{}, TransferRef{}, errors.New("Transfer offer " + offer.Id + " is " + offer.Status)
+	}
+
+	return offer, ref, nil
+}
+
+func (t *CounterfeitCC) closeTransfer(stub shim.ChaincodeStubInterface, offer TransferOffer, status string) pb.Response {
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer.Status = status
+	offer.Closed = now
+
+	err = t.putTransfer(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, err = t.withColdChain(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return shim.Error("Error generating transfer offer response")
+	}
+
+	return shim.Success(data)
+}
+
+// acceptTransfer is called by the buyer and moves the goods to it
+func (t *CounterfeitCC) acceptTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, ref, err := t.openTransfer(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if offer.Buyer != user.Name {
+		return shim.Error("Transfer offer " + offer.Id + " is not addressed to you")
+	}
+
+	err = t.checkSite(stub, ref.Site, user.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer.BuyerSite = ref.Site
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if now.After(offer.Expires) {
+		return shim.Error("Transfer offer " + offer.Id + " has expired")
+	}
+
+	// the seller may have been suspended or changed role since the offer was made
+	seller, err := t.findUser(stub, offer.Seller)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if seller.Status != UserApproved {
+		return shim.Error("Seller '" + seller.Name + "' is " + seller.Status)
+	}
+
+	_, err = t.checkFlow(stub, seller, user.Name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(offer.PackageIds) > 0 {
+		err = t.checkPackagesTransferable(stub, offer.Seller, offer.CartonId, offer.PackageIds)
+	} else {
+		err = t.checkTransferable(stub, offer.Seller, offer.CartonId, offer.ContainerId)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if len(offer.PackageIds) > 0 {
+		err = t.movePackages(stub, offer.CartonId, offer.PackageIds, user.Name)
+	} else if offer.ContainerId != "" {
+		err = t.moveContainer(stub, offer.ContainerId, user.Name)
+	} else {
+		err = t.updateCartonOwner(stub, offer.CartonId, user.Name)
+		if err == nil {
+			err = t.distributeCarton(stub, offer.CartonId)
+		}
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = t.recordHandover(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitEvent(stub, transferEvent(EventTransferCompleted, user.Name, offer))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return t.closeTransfer(stub, offer, TransferAccepted)
+}
+
+// rejectTransfer is called by the buyer and releases the carton
+func (t *CounterfeitCC) rejectTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, _, err := t.openTransfer(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if offer.Buyer != user.Name {
+		return shim.Error("Transfer offer " + offer.Id + " is not addressed to you")
+	}
+
+	return t.closeTransfer(stub, offer, TransferRejected)
+}
+
+// cancelTransfer is called by the seller before the buyer accepted
+func (t *CounterfeitCC) cancelTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	user, err := t.activeUser(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, _, err := t.openTransfer(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if offer.Seller != user.Name {
+		return shim.Error("Transfer offer " + offer.Id + " is not yours")
+	}
+
+	return t.closeTransfer(stub, offer, TransferCancelled)
+}
+
+func (t *CounterfeitCC) getTransferOffer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	ref := TransferRef{}
+	err := json.Unmarshal([]byte(args[0]), &ref)
+	if err != nil {
+		return shim.Error("Error parsing transfer request json")
+	}
+
+	offer, err := t.getTransfer(stub, ref.TransferId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offer, err = t.withColdChain(stub, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return shim.Error("Error generating transfer offer response")
+	}
+
+	return shim.Success(data)
+}
+
+// listTransfers returns the pending, not yet expired offers the caller is buyer or seller of
+func (t *CounterfeitCC) listTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var result []TransferOffer = []TransferOffer{}
+	for _, index := range []string{IndexTransferSeller, IndexTransferBuyer} {
+		iter, err := stub.GetStateByPartialCompositeKey(index, []string{caller})
+		if err != nil {
+			return shim.Error("Error listing transfer offers: " + err.Error())
+		}
+
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				iter.Close()
+				return shim.Error("Error listing transfer offers: " + err.Error())
+			}
+
+			_, attributes, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(attributes) != 2 {
+				iter.Close()
+				return shim.Error("Error parsing transfer offer key")
+			}
+
+			offer, err := t.getTransfer(stub, attributes[1])
+			if err != nil {
+				iter.Close()
+				return shim.Error(err.Error())
+			}
+
+			if offer.Status == TransferPending && !now.After(offer.Expires) {
+				offer, err = t.withColdChain(stub, offer)
+				if err != nil {
+					iter.Close()
+					return shim.Error(err.Error())
+				}
+
+				result = append(result, offer)
+			}
+		}
+		iter.Close()
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating transfer offer list response")
+	}
+
+	return shim.Success(data)
+}
+
+func transferEvent(eventType string, actor string, offer TransferOffer) Event {
+	return Event{
+		Type:        eventType,
+		Actor:       actor,
+		CartonId:    offer.CartonId,
+		PackageIds:  offer.PackageIds,
+		ContainerId: offer.ContainerId,
+		TransferId:  offer.Id,
+		Seller:      offer.Seller,
+		Buyer:       offer.Buyer,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ChaincodeVersion is the version of this code, Init records it in the settings
+const ChaincodeVersion = "1.1"
+
+// InitOptions are read from the Init argument next to the settings.
+// ChangeAdmin lets an upgrade hand the admin role to somebody else, without
+// it an upgrade keeps the admin.
+type InitOptions struct {
+	ChangeAdmin bool `json:"changeAdmin,omitempty"`
+}
+
+// Migration brings data written by an earlier version of the chaincode up to
+// what this version expects. Run has to cope with data it already migrated.
+type Migration struct {
+	Name string
+	Run  func(t *CounterfeitCC, stub shim.ChaincodeStubInterface) error
+}
+
+// Migrations run in order on the upgrade that first ships them. The names of
+// the ones that ran are kept in the settings, so never rename one.
+var Migrations = []Migration{
+	{"owner-index", migrateOwnerIndex},
+}
+
+// storedSettings returns the settings of an initialized ledger, initialized
+// is false if Init never ran before
+func (t *CounterfeitCC) storedSettings(stub shim.ChaincodeStubInterface) (Settings, bool, error) {
+	data, err := stub.GetState(KeySettings)
+	if err != nil {
+		return Settings{}, false, errors.New("Error getting settings: " + err.Error())
+	} else if data == nil {
+		return Settings{}, false, nil
+	}
+
+	settings := Settings{}
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return Settings{}, false, errors.New("Error parsing stored settings json: " + err.Error())
+	}
+
+	return settings, true, nil
+}
+
+func validateSettings(settings Settings) error {
+	if settings.Admin == "" {
+		return errors.New("The settings need an admin")
+	} else if settings.MaxBatchSize < 0 {
+		return errors.New("maxBatchSize must not be negative")
+	}
+
+	return nil
+}
+
+// migrate runs the migrations the ledger hasn't seen yet. A new ledger has
+// no data to migrate, all migrations count as done.
+func (t *CounterfeitCC) migrate(stub shim.ChaincodeStubInterface, settings *Settings, initialized bool) error {
+	for _, migration := range Migrations {
+		if contains(settings.Migrations, migration.Name) {
+			continue
+		}
+
+		if initialized {
+			err := migration.Run(t, stub)
+			if err != nil {
+				return errors.New("Migration " + migration.Name + " failed: " + err.Error())
+			}
+		}
+
+		settings.Migrations = append(settings.Migrations, migration.Name)
+	}
+
+	return nil
+}
+
+// migrateOwnerIndex adds the cartons created before the owner index to their
+// owner's inventory. The first versions never set the owner, those cartons
+// still belong to their producer.
+func migrateOwnerIndex(t *CounterfeitCC, stub shim.ChaincodeStubInterface) error {
+	cartons, err := t.findCartons(stub, func(carton Carton) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, carton := range cartons {
+		if carton.Owner == "" {
+			carton.Owner = carton.Producer
+			err = t.putCarton(stub, carton)
+			if err != nil {
+				return err
+			}
+		}
+
+		key, _ := stub.CreateCompositeKey(IndexOwner, []string{carton.Owner, carton.Id})
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return errors.New("Error getting owner index: " + err.Error())
+		} else if existing != nil {
+			continue
+		}
+
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return errors.New("Error updating owner index: " + err.Error())
+		}
+	}
+
+	return nil
+}
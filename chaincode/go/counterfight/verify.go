@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"counterfight/tagcode"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Scan is a verification of a package, Gln and Geo say where it happened if known
+type Scan struct {
+	TxId    string       `json:"txId"`
+	Scanner string       `json:"scanner"`
+	Time    time.Time    `json:"time"`
+	Verdict string       `json:"verdict"`
+	Gln     string       `json:"gln,omitempty"`
+	Geo     *GeoLocation `json:"geo,omitempty"`
+}
+
+type VerificationResult struct {
+	Verdict        string   `json:"verdict"`
+	CartonId       string   `json:"cartonId"`
+	PackageId      string   `json:"packageId"`
+	Producer       string   `json:"producer"`
+	ProductName    string   `json:"productName"`
+	ScansAfterSale int      `json:"scansAfterSale"`
+	ColdChain      string   `json:"coldChain,omitempty"`
+	Excursions     int      `json:"excursions,omitempty"`
+	Alerts         []string `json:"alerts,omitempty"`
+	Signature      string   `json:"signature,omitempty"`
+}
+
+// (cartonId, packageId, txId) -> Scan
+const IndexScan = "cn~scan"
+
+const VerdictGenuineUnsold = "genuine-unsold"
+const VerdictGenuineSold = "genuine-sold"
+const VerdictUnknown = "unknown"
+const VerdictRecalled = "recalled"
+const VerdictSuspicious = "suspicious"
+
+// checks a buyer may make of a sold package before it looks like a clone
+const MaxScansAfterSale = 1
+
+// verifyPackage tells whether a package is genuine and records the check as a scan.
+// Anybody with an identity on the channel may call it, consumers included.
+func (t *CounterfeitCC) verifyPackage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("expected 1 argument")
+	}
+
+	caller, err := CallerCN(stub)
+	if err != nil {
+		return shim.Error("Error extracting user identity")
+	}
+
+	packageRef, err := parsePackageRef(args[0])
+	if err != nil {
+		return shim.Error("Error parsing verifyPackage request json")
+	}
+
+	// a code that can't be read was most likely misscanned, the scanner should try again
+	if packageRef.Code != "" {
+		err = tagcode.Validate(packageRef.Code)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// an SGTIN or code that isn't registered is unknown, there is no package to record the scan on
+	resolved, err := t.resolvePackageRef(stub, packageRef)
+	if err != nil && (packageRef.Sgtin != "" || packageRef.Code != "") {
+		data, _ := json.Marshal(VerificationResult{Verdict: VerdictUnknown})
+		return shim.Success(data)
+	} else if err != nil {
+		return shim.Error(err.Error())
+	}
+	packageRef = resolved
+
+	geo, country, err := t.eventLocation(stub, caller, packageRef.Site, packageRef.Geo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := t.verify(stub, packageRef)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a package that fails a rule is suspicious, unless it's already known to be recalled
+	if result.Verdict != VerdictUnknown {
+		ctx, err := t.newRuleContext(stub, TriggerVerification, caller, packageRef, geo, country)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if packageRef.Signature != "" {
+			result.Signature, err = t.checkPackageSignature(stub, ctx.Carton, packageRef.PackageId, packageRef.Signature)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			ctx.Signature = result.Signature
+		}
+
+		alerts, err := t.runRules(stub, ctx)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		for _, alert := range alerts {
+			result.Alerts = append(result.Alerts, alert.Rule)
+		}
+
+		if len(alerts) > 0 && result.Verdict != VerdictRecalled {
+			result.Verdict = VerdictSuspicious
+		}
+	}
+
+	// a package that doesn't exist gets no scan, or anybody could create keys at will
+	if result.Verdict != VerdictUnknown {
+		now, err := txTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		scan := Scan{
+			TxId:    stub.GetTxID(),
+			Scanner: caller,
+			Time:    now,
+			Verdict: result.Verdict,
+			Gln:     packageRef.Site,
+			Geo:     geo,
+		}
+
+		err = t.putScan(stub, packageRef, scan)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if result.Verdict == VerdictSuspicious {
+		err = emitEvent(stub, Event{
+			Type:      EventSuspiciousScan,
+			Actor:     caller,
+			CartonId:  packageRef.CartonId,
+			PackageId: packageRef.PackageId,
+			Verdict:   result.Verdict,
+		})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error("Error generating verification response")
+	}
+
+	return shim.Success(data)
+}
+
+// verify works out the verdict for a package without writing anything
+func (t *CounterfeitCC) verify(stub shim.ChaincodeStubInterface, packageRef PackageRef) (VerificationResult, error) {
+	result := VerificationResult{
+		Verdict:   VerdictUnknown,
+		CartonId:  packageRef.CartonId,
+		PackageId: packageRef.PackageId,
+	}
+
+	carton, err := t.getCarton(stub, packageRef.CartonId)
+	if err != nil {
+		return result, nil
+	}
+
+	pckg, err := t.getPackage(stub, packageRef.CartonId, packageRef.PackageId)
+	if err != nil {
+		return result, nil
+	}
+
+	result.Producer = carton.Producer
+	result.ProductName = carton.Name
+
+	coldChain, err := t.getColdChain(stub, carton.Id)
+	if err != nil {
+		return result, err
+	}
+	result.ColdChain = coldChain.Status
+	result.Excursions = len(coldChain.Excursions)
+
+	switch pckg.State {
+	case PackageRecalled:
+		result.Verdict = VerdictRecalled
+		return result, nil
+	case PackageDestroyed:
+		// a destroyed package can't turn up again, the code was copied
+		result.Verdict = VerdictSuspicious
+		return result, nil
+	case PackageCreated, PackageInDistribution, PackageReturned:
+		result.Verdict = VerdictGenuineUnsold
+		return result, nil
+	}
+
+	scans, err := t.getScans(stub, packageRef)
+	if err != nil {
+		return result, err
+	}
+
+	for _, scan := range scans {
+		if scan.Time.After(pckg.SellDate) {
+			result.ScansAfterSale++
+		}
+	}
+
+	if result.ScansAfterSale >= MaxScansAfterSale {
+		result.Verdict = VerdictSuspicious
+	} else {
+		result.Verdict = VerdictGenuineSold
+	}
+
+	return result, nil
+}
+
+func (t *CounterfeitCC) putScan(stub shim.ChaincodeStubInterface, packageRef PackageRef, scan Scan) error {
+	key, _ := stub.CreateCompositeKey(IndexScan, []string{packageRef.CartonId, packageRef.PackageId, scan.TxId})
+
+	data, err := json.Marshal(scan)
+	if err != nil {
+		return errors.New("Error marshaling scan: " + err.Error())
+	}
+
+	err = stub.PutState(key, data)
+	if err != nil {
+		return errors.New("Error storing scan: " + err.Error())
+	}
+
+	return nil
+}
+
+func (t *CounterfeitCC) getScans(stub shim.ChaincodeStubInterface, packageRef PackageRef) ([]Scan, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(IndexScan, []string{packageRef.CartonId, packageRef.PackageId})
+	if err != nil {
+		return nil, errors.New("Error getting scans: " + err.Error())
+	}
+	defer iter.Close()
+
+	var result []Scan = []Scan{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading scans: " + err.Error())
+		}
+
+		scan := Scan{}
+		err = json.Unmarshal(kv.Value, &scan)
+		if err != nil {
+			return nil, errors.New("Error parsing scan json: " + err.Error())
+		}
+
+		result = append(result, scan)
+	}
+
+	return result, nil
+}